@@ -0,0 +1,187 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "sync"
+import "errors"
+
+import "github.com/proactivity-lab/go-loggers"
+import "github.com/proactivity-lab/go-moteconnection"
+
+// NodeParameterClient registers a single ActiveMessage dispatcher for
+// AMID_DEVICE_PARAMETERS and routes the received messages to per-node
+// managers by their source address, allowing many nodes to be queried in
+// parallel over one connection.
+type NodeParameterClient struct {
+	loggers.DIWEloggers
+	sfc moteconnection.MoteConnection
+	dsp *moteconnection.MessageDispatcher
+
+	mutex    sync.Mutex
+	sessions map[moteconnection.AMAddr]*DeviceParameterManager
+	closed   bool
+
+	heartbeatSubscribers []chan *DeviceHeartbeat
+
+	receive chan moteconnection.Packet
+
+	done    chan bool
+	stopped chan bool
+}
+
+func NewNodeParameterClient(sfc moteconnection.MoteConnection, group moteconnection.AMGroup, address moteconnection.AMAddr) *NodeParameterClient {
+	npc := new(NodeParameterClient)
+	npc.InitLoggers()
+	npc.sessions = make(map[moteconnection.AMAddr]*DeviceParameterManager)
+	npc.receive = make(chan moteconnection.Packet)
+	npc.done = make(chan bool)
+	npc.stopped = make(chan bool)
+
+	npc.dsp = moteconnection.NewMessageDispatcher(moteconnection.NewMessage(group, address))
+	npc.dsp.RegisterMessageReceiver(AMID_DEVICE_PARAMETERS, npc.receive)
+
+	npc.sfc = sfc
+	npc.sfc.AddDispatcher(npc.dsp)
+
+	go npc.run()
+	return npc
+}
+
+// Manager creates a manager for communicating with the destination node. Only
+// one manager can exist for a node at a time, it must be closed before a new
+// one can be created.
+func (self *NodeParameterClient) Manager(destination moteconnection.AMAddr) (*DeviceParameterManager, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return nil, ErrClosed
+	}
+	if _, ok := self.sessions[destination]; ok {
+		return nil, errors.New(fmt.Sprintf("Manager for node %s already exists!", destination))
+	}
+
+	dpm := newDeviceParameterManager(self.sfc)
+	dpm.SetLoggers(&self.DIWEloggers)
+	dpm.destination = destination
+	dpm.dsp = self.dsp
+	dpm.detach = func() {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+		if self.sessions[destination] == dpm {
+			delete(self.sessions, destination)
+		}
+	}
+	self.sessions[destination] = dpm
+
+	go dpm.run()
+	return dpm, nil
+}
+
+func (self *NodeParameterClient) run() {
+	defer close(self.stopped)
+
+	for {
+		select {
+		case packet := <-self.receive:
+			msg, ok := packet.(*moteconnection.Message)
+			if !ok {
+				continue
+			}
+
+			self.receivedHeartbeat(msg)
+
+			self.mutex.Lock()
+			dpm := self.sessions[msg.Source()]
+			self.mutex.Unlock()
+
+			if dpm != nil {
+				select {
+				case dpm.receive <- packet:
+				case <-dpm.done: // Closed while delivering
+				}
+			} else {
+				self.Debug.Printf("No manager for %s\n", packet)
+			}
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// receivedHeartbeat delivers the heartbeats of all nodes to the subscribers,
+// regardless of whether a manager exists for the node.
+func (self *NodeParameterClient) receivedHeartbeat(msg *moteconnection.Message) {
+	payload := msg.GetPayload()
+	if len(payload) == 0 || payload[0] != DP_HEARTBEAT {
+		return
+	}
+	p := new(DpHeartbeat)
+	if err := moteconnection.DeserializePacket(p, payload); err != nil {
+		self.Error.Printf("Deserialize error %s %s\n", err, msg)
+		return
+	}
+	hb := newDeviceHeartbeat(msg, p)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, subscriber := range self.heartbeatSubscribers {
+		select {
+		case subscriber <- hb:
+		default:
+			self.Debug.Printf("Heartbeat subscriber not keeping up\n")
+		}
+	}
+}
+
+// SubscribeHeartbeats returns a channel for receiving the heartbeats of all
+// nodes. Reboots are not detected, the Reboot field is always false.
+// Heartbeats are dropped if the subscriber does not keep up. The channel is
+// closed when the client is closed.
+func (self *NodeParameterClient) SubscribeHeartbeats() chan *DeviceHeartbeat {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	subscriber := make(chan *DeviceHeartbeat, 8)
+	if self.closed {
+		close(subscriber)
+	} else {
+		self.heartbeatSubscribers = append(self.heartbeatSubscribers, subscriber)
+	}
+	return subscriber
+}
+
+// Close closes all the managers that were created through the client and
+// removes the dispatcher from the connection.
+func (self *NodeParameterClient) Close() error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return errors.New("Close has already been called!")
+	}
+	self.closed = true
+	sessions := make([]*DeviceParameterManager, 0, len(self.sessions))
+	for _, dpm := range self.sessions {
+		sessions = append(sessions, dpm)
+	}
+	self.mutex.Unlock()
+
+	// The router keeps running until the managers are closed, so that the
+	// connection can not get stuck on delivery.
+	self.sfc.RemoveDispatcher(self.dsp)
+	for _, dpm := range sessions {
+		dpm.Close()
+	}
+	close(self.done)
+	<-self.stopped
+
+	self.mutex.Lock()
+	for _, subscriber := range self.heartbeatSubscribers {
+		close(subscriber)
+	}
+	self.heartbeatSubscribers = nil
+	self.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,118 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/proactivity-lab/go-moteconnection"
+)
+
+func TestClientRouting(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, responses are injected
+	client := NewNodeParameterClient(sfc, 0x22, 0x5678)
+
+	m1, err := client.Manager(0x0001)
+	if err != nil {
+		t.Fatalf("manager: %s", err)
+	}
+	if _, err := client.Manager(0x0001); err == nil {
+		t.Errorf("second manager for the same node was created")
+	}
+	m2, err := client.Manager(0x0002)
+	if err != nil {
+		t.Fatalf("manager: %s", err)
+	}
+	m1.SetTimeout(time.Second)
+	m2.SetTimeout(time.Second)
+
+	respond := func(source moteconnection.AMAddr, value byte) {
+		msg := client.dsp.NewMessage()
+		msg.SetSource(source)
+		msg.SetType(AMID_DEVICE_PARAMETERS)
+		msg.SetPayload(moteconnection.SerializePacket(&DpParameter{Header: DP_PARAMETER, Type: uint8(DP_TYPE_UINT8), Id: "radio_channel", Value: []byte{value}}))
+		client.receive <- msg
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		respond(0x0002, 22)
+		respond(0x0001, 11)
+	}()
+
+	done := make(chan bool)
+	for m, expected := range map[*DeviceParameterManager]byte{m1: 11, m2: 22} {
+		go func(m *DeviceParameterManager, expected byte) {
+			if v, err := m.GetValue("radio_channel"); err != nil {
+				t.Errorf("get: %s", err)
+			} else if v.Value[0] != expected {
+				t.Errorf("node %s got %d, expected %d", m.destination, v.Value[0], expected)
+			}
+			done <- true
+		}(m, expected)
+	}
+	<-done
+	<-done
+
+	if err := m1.Close(); err != nil {
+		t.Errorf("close: %s", err)
+	}
+	if _, err := client.Manager(0x0001); err != nil {
+		t.Errorf("manager could not be recreated: %s", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("close: %s", err)
+	}
+	if _, err := m2.GetValue("radio_channel"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := client.Manager(0x0003); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClientHeartbeats(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, heartbeats are injected
+	client := NewNodeParameterClient(sfc, 0x22, 0x5678)
+	hbs := client.SubscribeHeartbeats()
+
+	m, err := client.Manager(0x0001)
+	if err != nil {
+		t.Fatalf("manager: %s", err)
+	}
+	mhbs := m.SubscribeHeartbeats()
+
+	for _, source := range []moteconnection.AMAddr{0x0001, 0x0002} {
+		msg := client.dsp.NewMessage()
+		msg.SetSource(source)
+		msg.SetType(AMID_DEVICE_PARAMETERS)
+		msg.SetPayload(moteconnection.SerializePacket(&DpHeartbeat{DP_HEARTBEAT, uint64(source), 60}))
+		client.receive <- msg
+
+		select {
+		case hb := <-hbs:
+			if hb.Address != source || hb.Eui64 != uint64(source) || hb.Uptime != time.Minute {
+				t.Errorf("unexpected heartbeat %+v", hb)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("heartbeat from %s not delivered", source)
+		}
+	}
+
+	select {
+	case hb := <-mhbs:
+		if hb.Address != 0x0001 {
+			t.Errorf("manager got heartbeat from %s", hb.Address)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("heartbeat not delivered to the manager")
+	}
+
+	client.Close()
+	if _, ok := <-hbs; ok {
+		t.Errorf("subscription not closed")
+	}
+}
@@ -4,14 +4,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -28,95 +24,58 @@ const ApplicationVersionPatch = 0
 var ApplicationBuildDate string
 var ApplicationBuildDistro string
 
-func parseValue(opts Options) ([]byte, bool, error) {
+// parseValue uses the schema of the parameter for parsing when the type
+// matches, so that presented and symbolic values are accepted.
+func parseValue(opts Options, schema *deviceparameters.Schema) ([]byte, bool, error) {
 	var value []byte
-	var err error
-	var t interface{}
 	c := 0
 
-	if len(opts.Uint8) > 0 {
-		if v, err := strconv.ParseUint(opts.Uint8, 10, 8); err == nil {
-			t = uint8(v)
-			c++
-		} else {
-			return nil, false, err
-		}
-	}
-	if len(opts.Uint16) > 0 {
-		if v, err := strconv.ParseUint(opts.Uint16, 10, 16); err == nil {
-			t = uint16(v)
-			c++
-		} else {
-			return nil, false, err
-		}
-	}
-	if len(opts.Uint32) > 0 {
-		if v, err := strconv.ParseUint(opts.Uint32, 10, 32); err == nil {
-			t = uint32(v)
-			c++
-		} else {
-			return nil, false, err
-		}
-	}
-	if len(opts.Uint64) > 0 {
-		if v, err := strconv.ParseUint(opts.Uint64, 10, 64); err == nil {
-			t = uint64(v)
-			c++
-		} else {
-			return nil, false, err
-		}
+	var ps *deviceparameters.ParameterSchema
+	if schema != nil && len(opts.Parameter) > 0 {
+		ps = schema.Parameter(opts.Parameter[0])
 	}
-	if len(opts.Int8) > 0 {
-		if v, err := strconv.ParseInt(opts.Int8, 10, 8); err == nil {
-			t = int8(v)
-			c++
-		} else {
-			return nil, false, err
-		}
+
+	typed := []struct {
+		value string
+		t     deviceparameters.DeviceParameterType
+	}{
+		{opts.Uint8, deviceparameters.DP_TYPE_UINT8},
+		{opts.Uint16, deviceparameters.DP_TYPE_UINT16},
+		{opts.Uint32, deviceparameters.DP_TYPE_UINT32},
+		{opts.Uint64, deviceparameters.DP_TYPE_UINT64},
+		{opts.Int8, deviceparameters.DP_TYPE_INT8},
+		{opts.Int16, deviceparameters.DP_TYPE_INT16},
+		{opts.Int32, deviceparameters.DP_TYPE_INT32},
+		{opts.Int64, deviceparameters.DP_TYPE_INT64},
+		{opts.Value, deviceparameters.DP_TYPE_RAW},
+		{opts.String, deviceparameters.DP_TYPE_STRING},
 	}
-	if len(opts.Int16) > 0 {
-		if v, err := strconv.ParseInt(opts.Int16, 10, 16); err == nil {
-			t = int16(v)
+	for _, tv := range typed {
+		if len(tv.value) > 0 {
+			var v []byte
+			var err error
+			if ps != nil && ps.Type == tv.t {
+				v, err = ps.ParseValue(tv.value)
+			} else {
+				v, err = deviceparameters.ParseParameterValue(tv.t, tv.value)
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			value = v
 			c++
-		} else {
-			return nil, false, err
 		}
 	}
-	if len(opts.Int32) > 0 {
-		if v, err := strconv.ParseInt(opts.Int32, 10, 32); err == nil {
-			t = int32(v)
-			c++
-		} else {
-			return nil, false, err
+
+	if len(opts.Set) > 0 {
+		if ps == nil {
+			return nil, false, errors.New("Parameter schema is needed for setting a value with --set")
 		}
-	}
-	if len(opts.Int64) > 0 {
-		if v, err := strconv.ParseInt(opts.Int64, 10, 64); err == nil {
-			t = int64(v)
-			c++
-		} else {
+		v, err := ps.ParseValue(opts.Set)
+		if err != nil {
 			return nil, false, err
 		}
-	}
-
-	if t != nil {
-		switch t := t.(type) {
-		case uint8, uint16, uint32, uint64, int8, int16, int32, int64:
-			buf := new(bytes.Buffer)
-			if err := binary.Write(buf, binary.BigEndian, t); err != nil {
-				return nil, false, err
-			}
-			value = buf.Bytes()
-		}
-	}
-
-	if len(opts.Value) > 0 {
-		value, err = hex.DecodeString(opts.Value)
-		c++
-	}
-
-	if len(opts.String) > 0 {
-		value = []byte(opts.String)
+		value = v
 		c++
 	}
 
@@ -129,7 +88,39 @@ func parseValue(opts Options) ([]byte, bool, error) {
 		return nil, false, errors.New("Multiple values specified for parameter")
 	}
 
-	return value, c > 0, err
+	return value, c > 0, nil
+}
+
+func present(val *deviceparameters.DeviceParameter, format deviceparameters.ValueFormat, schema *deviceparameters.Schema) string {
+	if schema != nil {
+		if ps := schema.Parameter(val.Name); ps != nil && ps.Type == val.Type {
+			if s, err := ps.FormatValue(val.Value); err == nil {
+				if len(ps.Unit) > 0 && len(ps.Presentation) == 0 && len(ps.Enum) == 0 && len(ps.Flags) == 0 {
+					return s + " " + ps.Unit
+				}
+				return s
+			}
+		}
+	}
+	if s, err := deviceparameters.FormatParameterValue(val.Type, val.Value, format); err == nil {
+		return s
+	}
+	return val.String()
+}
+
+// waitEui64 waits for a heartbeat, if none was received during the discovery,
+// so that the schema can identify the device.
+func waitEui64(schema *deviceparameters.Schema, hbs chan *deviceparameters.DeviceHeartbeat, timeout time.Duration) error {
+	if len(schema.Eui64) > 0 {
+		return nil
+	}
+	select {
+	case hb := <-hbs:
+		schema.Eui64 = fmt.Sprintf("%016X", hb.Eui64)
+		return nil
+	case <-time.After(timeout):
+		return errors.New("No heartbeat received, EUI-64 of the device is not known")
+	}
 }
 
 type Options struct {
@@ -157,6 +148,12 @@ type Options struct {
 	Int32  string `long:"i32" description:"Set value, type is int32"`
 	Int64  string `long:"i64" description:"Set value, type is int64"`
 	Null   []bool `long:"null" description:"Set value to empty"`
+	Set    string `long:"set" description:"Set value, type and presentation from the schema"`
+
+	Format string `long:"format" default:"dec" choice:"dec" choice:"hex" choice:"bin" description:"Integer value format"`
+	Schema string `long:"schema" default:"" description:"Parameter schema for validating and presenting values, JSON or YAML"`
+
+	DumpSchema string `long:"dump-schema" default:"" description:"Enumerate all parameters and store them as a schema, JSON or YAML"`
 
 	Quiet       []bool `short:"Q" long:"quiet"   description:"Quiet mode, print only values"`
 	Debug       []bool `short:"D" long:"debug"   description:"Debug mode, print raw packets"`
@@ -183,6 +180,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	format, err := deviceparameters.ParseValueFormat(opts.Format)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	var schema *deviceparameters.Schema
+	if len(opts.Schema) > 0 {
+		if schema, err = deviceparameters.ReadSchema(opts.Schema); err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	conn, cs, err := moteconnection.CreateConnection(opts.Positional.ConnectionString)
 	if err != nil {
 		fmt.Printf("ERROR: %s\n", err)
@@ -197,6 +208,7 @@ func main() {
 	}
 	dpm.SetTimeout(time.Duration(opts.Timeout) * time.Second)
 	dpm.SetRetries(opts.Retries)
+	dpm.SetSchema(schema)
 
 	logger := logsetup(len(opts.Debug))
 	if len(opts.Debug) > 0 {
@@ -215,8 +227,31 @@ func main() {
 
 	success := false
 
-	if len(opts.Parameter) > 0 {
-		value, set, err := parseValue(opts)
+	if len(opts.DumpSchema) > 0 {
+		if len(opts.Quiet) == 0 {
+			logger.Info.Printf("Discover parameters:\n")
+		}
+		hbs := dpm.SubscribeHeartbeats()
+		discovered, err := dpm.DiscoverSchema()
+		if err == nil {
+			if werr := waitEui64(discovered, hbs, time.Duration(opts.Timeout)*time.Second); werr != nil {
+				logger.Warning.Printf("%s\n", werr)
+			}
+			err = deviceparameters.WriteSchema(opts.DumpSchema, discovered)
+		}
+		if err != nil {
+			logger.Error.Printf("%s\n", err)
+		} else {
+			for _, ps := range discovered.Parameters {
+				logger.Debug.Printf("%2d: %s %s %s\n", *ps.Seqnum, ps.Name, ps.Type, ps.Value)
+			}
+			if len(opts.Quiet) == 0 {
+				logger.Info.Printf("Stored %d parameters in %s\n", len(discovered.Parameters), opts.DumpSchema)
+			}
+			success = true
+		}
+	} else if len(opts.Parameter) > 0 {
+		value, set, err := parseValue(opts, schema)
 		if err != nil {
 			logger.Error.Printf("%s", err)
 		} else if set && len(opts.Parameter) > 1 {
@@ -228,7 +263,7 @@ func main() {
 				}
 				val, err := dpm.GetValue(parameter)
 				if err == nil {
-					logger.Info.Printf("%s = %s\n", val.Name, val)
+					logger.Info.Printf("%s = %s\n", val.Name, present(val, format, schema))
 					success = true
 				} else {
 					logger.Info.Printf("Failed: %s\n", err)
@@ -237,7 +272,7 @@ func main() {
 		} else { // Set only if value and only a single parameter
 			logger.Info.Printf("Set %s to 0x%X\n", opts.Parameter[0], value)
 			if val, err := dpm.SetValue(opts.Parameter[0], value); err == nil {
-				logger.Info.Printf("%s = %s\n", val.Name, val)
+				logger.Info.Printf("%s = %s\n", val.Name, present(val, format, schema))
 				success = true
 			} else {
 				logger.Info.Printf("Failed: %s\n", err)
@@ -252,7 +287,7 @@ func main() {
 			param := <-pchan
 			for ; param != nil; param = <-pchan {
 				if param.Error == nil {
-					logger.Info.Printf("%2d: %s %s\n", param.Seqnum, param.Name, param)
+					logger.Info.Printf("%2d: %s %s\n", param.Seqnum, param.Name, present(param, format, schema))
 				} else {
 					logger.Info.Printf("%2d: %s\n", param.Seqnum, param.Error)
 				}
@@ -13,6 +13,8 @@ import (
 	"github.com/jessevdk/go-flags"
 	"github.com/proactivity-lab/go-loggers"
 	"github.com/proactivity-lab/go-moteconnection"
+
+	deviceparameters "github.com/thinnect/go-devparam"
 	"github.com/thinnect/go-devparam/director"
 )
 
@@ -36,9 +38,26 @@ type Options struct {
 	Template string `short:"t" long:"template" default:"" description:"Template for activities."`
 	List     string `short:"l" long:"list" default:"" description:"List of nodes to apply the template for."`
 
+	Desired string `long:"desired" default:"" description:"Desired state of node groups to compile the tasks from, JSON or YAML"`
+	Listen  int    `long:"listen" default:"0" description:"Time to wait for nodes joining the desired state groups (seconds)"`
+
 	Timeout int   `long:"timeout" default:"10" description:"Get/set action timeout (seconds)"`
 	Retries uint8 `long:"retries" default:"3" description:"Get/set action retries"`
 
+	Concurrency int `long:"concurrency" default:"1" description:"Number of nodes worked on simultaneously"`
+	Backoff     int `long:"backoff" default:"10" description:"Initial delay before retrying an unreachable node (seconds)"`
+	MaxBackoff  int `long:"max-backoff" default:"600" description:"Maximum delay before retrying an unreachable node (seconds)"`
+
+	Verify []bool `long:"verify" description:"Read completed tasks again and re-apply values that have drifted"`
+	Plan   []bool `long:"plan" description:"Read the current values and show what would be changed, without setting anything"`
+
+	MismatchReread  []bool `long:"mismatch-reread" description:"Read the value again when a set returns a different value"`
+	MismatchRetries int    `long:"mismatch-retries" default:"0" description:"Repeat a set that returns a different value"`
+	MismatchAccept  []bool `long:"mismatch-accept" description:"Accept a different value returned by a set, if it is valid in the schema"`
+
+	Format string `long:"format" default:"dec" choice:"dec" choice:"hex" choice:"bin" description:"Integer value format in the output file"`
+	Schema string `long:"schema" default:"" description:"Parameter schema for validating tasks, JSON or YAML"`
+
 	Debug       []bool `short:"D" long:"debug"   description:"Debug mode, print raw packets"`
 	ShowVersion func() `short:"V" long:"version" description:"Show application version"`
 }
@@ -69,9 +88,41 @@ func main() {
 		os.Exit(1)
 	}
 
+	format, err := deviceparameters.ParseValueFormat(opts.Format)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	var schema *deviceparameters.Schema
+	if len(opts.Schema) > 0 {
+		if schema, err = deviceparameters.ReadSchema(opts.Schema); err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var state *director.DesiredState
+	if len(opts.Desired) > 0 {
+		if state, err = director.ReadDesiredState(opts.Desired); err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	dpd, err := director.NewDeviceParameterDirector(conn, opts.Group, opts.Address,
 		director.Timeout(time.Duration(opts.Timeout)*time.Second),
-		director.Retries(opts.Retries))
+		director.Retries(opts.Retries),
+		director.Concurrency(opts.Concurrency),
+		director.Verify(len(opts.Verify) > 0),
+		director.Mismatch(director.MismatchPolicy{
+			Reread:  len(opts.MismatchReread) > 0,
+			Retries: opts.MismatchRetries,
+			Accept:  len(opts.MismatchAccept) > 0}),
+		director.Backoff(time.Duration(opts.Backoff)*time.Second, time.Duration(opts.MaxBackoff)*time.Second),
+		director.Listen(time.Duration(opts.Listen)*time.Second),
+		director.Format(format),
+		director.Schema(schema))
 
 	if err != nil {
 		fmt.Printf("ERROR: %s\n", err)
@@ -96,15 +147,30 @@ func main() {
 
 	success := false
 
-	if len(opts.Template) > 0 && len(opts.List) > 0 {
+	if len(opts.Plan) > 0 {
+		var plan *director.Plan
+		if state != nil {
+			plan, err = dpd.PlanWithDesiredState(opts.Positional.File, state, opts.List)
+		} else if len(opts.Template) > 0 && len(opts.List) > 0 {
+			plan, err = dpd.PlanWithTemplate(opts.Positional.File, opts.Template, opts.List)
+		} else {
+			plan, err = dpd.Plan(opts.Positional.File)
+		}
+		if err == nil {
+			plan.Write(os.Stdout)
+			success = true
+		}
+	} else if state != nil {
+		err = dpd.StartWithDesiredState(opts.Positional.File, state, opts.List)
+	} else if len(opts.Template) > 0 && len(opts.List) > 0 {
 		err = dpd.StartWithTemplate(opts.Positional.File, opts.Template, opts.List)
 	} else {
 		err = dpd.Start(opts.Positional.File)
 	}
 	if err != nil {
 		fmt.Printf("ERROR: %s\n", err)
-	} else {
-		signals := make(chan os.Signal)
+	} else if len(opts.Plan) == 0 {
+		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, os.Interrupt, os.Kill)
 
 		for interrupted := false; interrupted == false; {
@@ -122,6 +188,18 @@ func main() {
 		}
 
 		dpd.Stop()
+
+		unreachable := 0
+		for _, st := range dpd.Statistics() {
+			logger.Debug.Printf("Node %s: %d completed, %d failed, %d timeouts, %d heartbeats, last seen %s\n",
+				st.Address, st.Successes, st.Failures, st.Timeouts, st.Heartbeats, lastSeen(st.LastSeen))
+			if st.ConsecutiveTimeouts > 0 {
+				unreachable++
+			}
+		}
+		if unreachable > 0 {
+			logger.Warning.Printf("%d nodes did not respond to the last attempt\n", unreachable)
+		}
 	}
 
 	conn.Disconnect()
@@ -135,6 +213,13 @@ func main() {
 	}
 }
 
+func lastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
 func logsetup(debuglevel int) *loggers.DIWEloggers {
 	logger := loggers.New()
 	logformat := log.Ldate | log.Ltime | log.Lmicroseconds
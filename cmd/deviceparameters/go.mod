@@ -16,4 +16,5 @@ require (
 	github.com/joaojeronimo/go-crc16 v0.0.0-20140729130949-59bd0194935e // indirect
 	go.bug.st/serial.v1 v0.0.0-20191202182710-24a6610f0541 // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,283 @@
+// Author  Raido Pahtma
+// License MIT
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/proactivity-lab/go-loggers"
+	"github.com/proactivity-lab/go-moteconnection"
+
+	"github.com/thinnect/go-devparam/devsim"
+)
+
+const ApplicationVersionMajor = 0
+const ApplicationVersionMinor = 1
+const ApplicationVersionPatch = 0
+
+var ApplicationBuildDate string
+var ApplicationBuildDistro string
+
+type Options struct {
+	Positional struct {
+		ConnectionString string `description:"Connectionstring to listen on, sf@HOST:PORT"`
+	} `positional-args:"yes"`
+
+	Group moteconnection.AMGroup `short:"g" long:"group" default:"22" description:"Packet AM Group (hex)"`
+
+	Table  string   `short:"t" long:"table" description:"Default parameter table file, JSON or CSV"`
+	List   string   `short:"l" long:"list" description:"Node list file, an address and an optional table per line"`
+	Nodes  []string `short:"n" long:"node" description:"Node address or address range START-END (hex)"`
+	Serial string   `short:"s" long:"serial" description:"Address of the node answering raw serial requests (hex)"`
+	Eui64  string   `long:"eui" default:"0000000000000000" description:"EUI-64 base, the node address is added to it (hex)"`
+
+	Heartbeat int `long:"heartbeat" default:"60" description:"Heartbeat period (seconds), 0 to disable"`
+
+	Drop      float64 `long:"drop" default:"0" description:"Probability of losing a request or a response"`
+	Duplicate float64 `long:"duplicate" default:"0" description:"Probability of duplicating a response"`
+	Delay     int     `long:"delay" default:"0" description:"Response delay (milliseconds)"`
+	Jitter    int     `long:"jitter" default:"0" description:"Random additional response delay (milliseconds)"`
+
+	Debug       []bool `short:"D" long:"debug"   description:"Debug mode, print raw packets"`
+	ShowVersion func() `short:"V" long:"version" description:"Show application version"`
+}
+
+type nodeEntry struct {
+	address moteconnection.AMAddr
+	table   string
+}
+
+func parseAddressRange(s string) ([]moteconnection.AMAddr, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return nil, err
+	}
+	end := start
+	if len(parts) > 1 {
+		if end, err = strconv.ParseUint(parts[1], 16, 16); err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, errors.New(fmt.Sprintf("Invalid address range %s!", s))
+		}
+	}
+	addresses := make([]moteconnection.AMAddr, 0, end-start+1)
+	for addr := start; addr <= end; addr++ {
+		addresses = append(addresses, moteconnection.AMAddr(addr))
+	}
+	return addresses, nil
+}
+
+// readNodeList reads a node list file, every line holds a hex address and
+// optionally a parameter table, relative to the list file.
+func readNodeList(path string) ([]nodeEntry, error) {
+	nf, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer nf.Close()
+
+	scanner := bufio.NewScanner(bufio.NewReader(nf))
+
+	nodes := make([]nodeEntry, 0)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		entry := nodeEntry{address: moteconnection.AMAddr(addr)}
+		if len(fields) > 1 {
+			entry.table = fields[1]
+			if !filepath.IsAbs(entry.table) {
+				entry.table = filepath.Join(filepath.Dir(path), entry.table)
+			}
+		}
+		nodes = append(nodes, entry)
+	}
+	return nodes, scanner.Err()
+}
+
+func createNodes(opts Options) ([]*devsim.Node, error) {
+	entries := make([]nodeEntry, 0)
+	if len(opts.List) > 0 {
+		listed, err := readNodeList(opts.List)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, listed...)
+	}
+	for _, n := range opts.Nodes {
+		addresses, err := parseAddressRange(n)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addresses {
+			entries = append(entries, nodeEntry{address: addr})
+		}
+	}
+
+	eui64, err := strconv.ParseUint(opts.Eui64, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	faults := devsim.Faults{
+		Drop:      opts.Drop,
+		Duplicate: opts.Duplicate,
+		Delay:     time.Duration(opts.Delay) * time.Millisecond,
+		Jitter:    time.Duration(opts.Jitter) * time.Millisecond,
+	}
+
+	tables := make(map[string][]devsim.Parameter)
+	nodes := make([]*devsim.Node, 0, len(entries))
+	for _, e := range entries {
+		table := e.table
+		if len(table) == 0 {
+			table = opts.Table
+		}
+		if len(table) == 0 {
+			return nil, errors.New(fmt.Sprintf("No parameter table for node %s!", e.address))
+		}
+		params, ok := tables[table]
+		if !ok {
+			if params, err = devsim.ReadParameterTable(table); err != nil {
+				return nil, err
+			}
+			tables[table] = params
+		}
+		node := devsim.NewNode(e.address, eui64+uint64(e.address), params...)
+		node.SetFaults(faults)
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func main() {
+
+	var opts Options
+	opts.ShowVersion = func() {
+		if ApplicationBuildDate == "" {
+			ApplicationBuildDate = "YYYY-mm-dd_HH:MM:SS"
+		}
+		if ApplicationBuildDistro == "" {
+			ApplicationBuildDistro = "unknown"
+		}
+		fmt.Printf("deviceparamsim %d.%d.%d (%s %s)\n", ApplicationVersionMajor, ApplicationVersionMinor, ApplicationVersionPatch, ApplicationBuildDate, ApplicationBuildDistro)
+		os.Exit(0)
+	}
+
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		fmt.Printf("Argument parser error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(opts.Positional.ConnectionString) == 0 {
+		opts.Positional.ConnectionString = "sf@0.0.0.0:9002"
+	}
+
+	logger := logsetup(len(opts.Debug))
+
+	nodes, err := createNodes(opts)
+	if err != nil {
+		logger.Error.Printf("%s\n", err)
+		os.Exit(1)
+	}
+
+	network := devsim.NewNetwork()
+	if len(opts.Debug) > 0 {
+		network.SetLoggers(logger)
+	}
+	for _, node := range nodes {
+		network.AddNode(node)
+	}
+	if len(opts.Serial) > 0 {
+		addr, err := strconv.ParseUint(opts.Serial, 16, 16)
+		if err != nil {
+			logger.Error.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		node := network.Node(moteconnection.AMAddr(addr))
+		if node == nil {
+			logger.Error.Printf("Serial node %s is not in the node list\n", moteconnection.AMAddr(addr))
+			os.Exit(1)
+		}
+		network.SetSerialNode(node)
+	}
+	if len(nodes) == 0 {
+		logger.Warning.Printf("No nodes specified\n")
+	}
+
+	conn, cs, err := moteconnection.CreateConnection(opts.Positional.ConnectionString)
+	if err != nil {
+		logger.Error.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	sfc, ok := conn.(*moteconnection.SfConnection)
+	if !ok {
+		logger.Error.Printf("Only sf@HOST:PORT connections can be served, not %s\n", cs)
+		os.Exit(1)
+	}
+	if len(opts.Debug) > 1 {
+		sfc.SetLoggers(logger)
+	}
+
+	if err := network.Attach(sfc, opts.Group); err != nil {
+		logger.Error.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	if err := sfc.Listen(); err != nil {
+		logger.Error.Printf("Unable to listen on %s: %s\n", cs, err)
+		os.Exit(1)
+	}
+	logger.Info.Printf("Serving %d nodes on %s\n", len(nodes), cs)
+
+	if opts.Heartbeat > 0 {
+		network.StartHeartbeats(time.Duration(opts.Heartbeat) * time.Second)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	sig := <-signals
+	signal.Stop(signals)
+	logger.Debug.Printf("signal %s\n", sig)
+
+	network.Close()
+	sfc.Disconnect()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func logsetup(debuglevel int) *loggers.DIWEloggers {
+	logger := loggers.New()
+	logformat := log.Ldate | log.Ltime | log.Lmicroseconds
+
+	if debuglevel > 1 {
+		logformat = logformat | log.Lshortfile
+	}
+
+	if debuglevel > 0 {
+		logger.SetDebugLogger(log.New(os.Stdout, "DEBUG: ", logformat))
+		logger.SetInfoLogger(log.New(os.Stdout, "INFO:  ", logformat))
+	} else {
+		logger.SetInfoLogger(log.New(os.Stdout, "", logformat))
+	}
+	logger.SetWarningLogger(log.New(os.Stdout, "WARN:  ", logformat))
+	logger.SetErrorLogger(log.New(os.Stdout, "ERROR: ", logformat))
+	return logger
+}
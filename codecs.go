@@ -0,0 +1,234 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "sync"
+import "errors"
+import "strconv"
+import "strings"
+import "encoding/hex"
+import "encoding/binary"
+
+// Codec converts the values of a parameter type between their binary form,
+// as transferred by the protocol, and their text form, as used in task files
+// and on the command line.
+type Codec interface {
+	Encode(text string) ([]byte, error)
+	Decode(value []byte) (string, error)
+	Validate(value []byte) error
+}
+
+// ValueFormat selects how integer values are presented as text, values in all
+// formats are accepted by Encode.
+type ValueFormat uint8
+
+const (
+	FormatDecimal ValueFormat = iota
+	FormatHex                 // 0x1F40, zero padded to the size of the type
+	FormatBinary              // 0b00001010, zero padded to the size of the type
+)
+
+var ValueFormatToString = map[ValueFormat]string{
+	FormatDecimal: "dec",
+	FormatHex:     "hex",
+	FormatBinary:  "bin",
+}
+
+func (format ValueFormat) String() string {
+	return ValueFormatToString[format]
+}
+
+func ParseValueFormat(name string) (ValueFormat, error) {
+	for format, s := range ValueFormatToString {
+		if s == name {
+			return format, nil
+		}
+	}
+	return FormatDecimal, errors.New(fmt.Sprintf("%s is not a valid value format!", name))
+}
+
+// FormattedCodec is implemented by codecs that can present values in more
+// than one format.
+type FormattedCodec interface {
+	Codec
+	DecodeFormat(value []byte, format ValueFormat) (string, error)
+}
+
+var codecMutex sync.RWMutex
+
+var codecs = map[DeviceParameterType]Codec{
+	DP_TYPE_RAW:    rawCodec{},
+	DP_TYPE_STRING: stringCodec{},
+	DP_TYPE_NIL:    nilCodec{},
+	DP_TYPE_UINT8:  integerCodec{DP_TYPE_UINT8, 1, false},
+	DP_TYPE_UINT16: integerCodec{DP_TYPE_UINT16, 2, false},
+	DP_TYPE_UINT32: integerCodec{DP_TYPE_UINT32, 4, false},
+	DP_TYPE_UINT64: integerCodec{DP_TYPE_UINT64, 8, false},
+	DP_TYPE_INT8:   integerCodec{DP_TYPE_INT8, 1, true},
+	DP_TYPE_INT16:  integerCodec{DP_TYPE_INT16, 2, true},
+	DP_TYPE_INT32:  integerCodec{DP_TYPE_INT32, 4, true},
+	DP_TYPE_INT64:  integerCodec{DP_TYPE_INT64, 8, true},
+}
+
+// RegisterCodec sets the codec used for a parameter type, replacing the
+// built-in codec if there is one.
+func RegisterCodec(dpt DeviceParameterType, codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+	codecs[dpt] = codec
+}
+
+func LookupCodec(dpt DeviceParameterType) (Codec, error) {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	if codec, ok := codecs[dpt]; ok {
+		return codec, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unrecognized parameter type 0x%02X!", uint8(dpt)))
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Encode(text string) ([]byte, error)  { return hex.DecodeString(text) }
+func (rawCodec) Decode(value []byte) (string, error) { return fmt.Sprintf("%X", value), nil }
+func (rawCodec) Validate(value []byte) error         { return nil }
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(text string) ([]byte, error)  { return []byte(text), nil }
+func (stringCodec) Decode(value []byte) (string, error) { return string(value), nil }
+func (stringCodec) Validate(value []byte) error         { return nil }
+
+// nilCodec is used for parameters that carry no value.
+type nilCodec struct{}
+
+func (nilCodec) Encode(text string) ([]byte, error) {
+	if len(text) > 0 {
+		return nil, errors.New(fmt.Sprintf("'%s' given for a nil value!", text))
+	}
+	return nil, nil
+}
+
+func (c nilCodec) Decode(value []byte) (string, error) {
+	if err := c.Validate(value); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (nilCodec) Validate(value []byte) error {
+	if len(value) > 0 {
+		return errors.New(fmt.Sprintf("Value %X is not a valid nil!", value))
+	}
+	return nil
+}
+
+// integerCodec handles big-endian integers.
+type integerCodec struct {
+	dpt    DeviceParameterType
+	size   int
+	signed bool
+}
+
+// Encode accepts decimal numbers and numbers with a 0x, 0b or 0o prefix. A
+// leading 0 without a letter is decimal, not octal.
+func (c integerCodec) Encode(text string) ([]byte, error) {
+	digits, base, negative := splitIntegerPrefix(text)
+	buf := make([]byte, 8)
+	if c.signed {
+		if negative {
+			digits = "-" + digits
+		}
+		v, err := strconv.ParseInt(digits, base, c.size*8)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(buf, uint64(v))
+	} else {
+		if negative {
+			return nil, errors.New(fmt.Sprintf("'%s' is negative, %s is unsigned!", text, c.dpt))
+		}
+		v, err := strconv.ParseUint(digits, base, c.size*8)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(buf, v)
+	}
+	return buf[8-c.size:], nil
+}
+
+func splitIntegerPrefix(text string) (string, int, bool) {
+	negative := false
+	if strings.HasPrefix(text, "-") {
+		negative = true
+		text = text[1:]
+	} else if strings.HasPrefix(text, "+") {
+		text = text[1:]
+	}
+	if len(text) > 2 && text[0] == '0' {
+		switch text[1] {
+		case 'x', 'X':
+			return text[2:], 16, negative
+		case 'b', 'B':
+			return text[2:], 2, negative
+		case 'o', 'O':
+			return text[2:], 8, negative
+		}
+	}
+	return text, 10, negative
+}
+
+func (c integerCodec) Decode(value []byte) (string, error) {
+	return c.DecodeFormat(value, FormatDecimal)
+}
+
+// DecodeFormat presents negative values with a minus sign in all formats, so
+// that they can be encoded again.
+func (c integerCodec) DecodeFormat(value []byte, format ValueFormat) (string, error) {
+	if err := c.Validate(value); err != nil {
+		return "", err
+	}
+	v := c.integer(value)
+
+	sign := ""
+	if c.signed && int64(v) < 0 {
+		sign = "-"
+		v = uint64(-int64(v))
+	}
+	switch format {
+	case FormatHex:
+		return fmt.Sprintf("%s0x%0*X", sign, c.size*2, v), nil
+	case FormatBinary:
+		return fmt.Sprintf("%s0b%0*b", sign, c.size*8, v), nil
+	}
+	return sign + strconv.FormatUint(v, 10), nil
+}
+
+func (c integerCodec) Validate(value []byte) error {
+	if len(value) != c.size {
+		return errors.New(fmt.Sprintf("Value %X is not a valid %s, %d bytes expected!", value, c.dpt, c.size))
+	}
+	return nil
+}
+
+// integer returns a validated value as a 64-bit integer, signed values are
+// sign extended and can be converted with int64.
+func (c integerCodec) integer(value []byte) uint64 {
+	buf := make([]byte, 8)
+	if c.signed && value[0]&0x80 != 0 { // Sign extension
+		for i := range buf {
+			buf[i] = 0xFF
+		}
+	}
+	copy(buf[8-c.size:], value)
+	return binary.BigEndian.Uint64(buf)
+}
+
+func builtinIntegerCodec(dpt DeviceParameterType) (integerCodec, error) {
+	if size := dpt.Size(); size > 0 {
+		return integerCodec{dpt, size, dpt&0x80 != 0}, nil
+	}
+	return integerCodec{}, errors.New(fmt.Sprintf("%s is not an integer type!", dpt))
+}
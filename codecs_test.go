@@ -0,0 +1,180 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		dpt   DeviceParameterType
+		text  string
+		value []byte
+	}{
+		{DP_TYPE_RAW, "", []byte{}},
+		{DP_TYPE_RAW, "0102AB", []byte{1, 2, 0xAB}},
+		{DP_TYPE_STRING, "", []byte{}},
+		{DP_TYPE_STRING, "node 1", []byte("node 1")},
+		{DP_TYPE_NIL, "", nil},
+		{DP_TYPE_UINT8, "0", []byte{0}},
+		{DP_TYPE_UINT8, "255", []byte{0xFF}},
+		{DP_TYPE_UINT16, "4660", []byte{0x12, 0x34}},
+		{DP_TYPE_UINT16, "65535", []byte{0xFF, 0xFF}},
+		{DP_TYPE_UINT32, "4294967295", []byte{0xFF, 0xFF, 0xFF, 0xFF}},
+		{DP_TYPE_UINT64, "18446744073709551615", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{DP_TYPE_UINT64, "1", []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+		{DP_TYPE_INT8, "-128", []byte{0x80}},
+		{DP_TYPE_INT8, "127", []byte{0x7F}},
+		{DP_TYPE_INT16, "-2", []byte{0xFF, 0xFE}},
+		{DP_TYPE_INT32, "-2147483648", []byte{0x80, 0, 0, 0}},
+		{DP_TYPE_INT32, "1546336768", []byte{0x5C, 0x2B, 0x3A, 0x00}},
+		{DP_TYPE_INT64, "-1", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{DP_TYPE_INT64, "9223372036854775807", []byte{0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+
+	for _, test := range tests {
+		value, err := ParseParameterValue(test.dpt, test.text)
+		if err != nil || !bytes.Equal(value, test.value) {
+			t.Errorf("%s encode \"%s\": %X %v", test.dpt, test.text, value, err)
+		}
+		text, err := ParameterValueString(test.dpt, test.value)
+		if err != nil || text != test.text {
+			t.Errorf("%s decode %X: \"%s\" %v", test.dpt, test.value, text, err)
+		}
+		dp := &DeviceParameter{Type: test.dpt, Value: test.value}
+		if s := dp.String(); s != test.text {
+			t.Errorf("%s String %X: \"%s\"", test.dpt, test.value, s)
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	encode := []struct {
+		dpt  DeviceParameterType
+		text string
+	}{
+		{DP_TYPE_RAW, "123"},
+		{DP_TYPE_RAW, "XY"},
+		{DP_TYPE_NIL, "1"},
+		{DP_TYPE_UINT8, "256"},
+		{DP_TYPE_UINT8, "-1"},
+		{DP_TYPE_UINT8, ""},
+		{DP_TYPE_UINT16, "65536"},
+		{DP_TYPE_UINT32, "abc"},
+		{DP_TYPE_INT8, "128"},
+		{DP_TYPE_INT16, "-32769"},
+		{DP_TYPE_INT64, "9223372036854775808"},
+		{DeviceParameterType(0x10), "1"},
+	}
+	for _, test := range encode {
+		if value, err := ParseParameterValue(test.dpt, test.text); err == nil {
+			t.Errorf("%s encode \"%s\" succeeded with %X", test.dpt, test.text, value)
+		}
+	}
+
+	decode := []struct {
+		dpt   DeviceParameterType
+		value []byte
+	}{
+		{DP_TYPE_NIL, []byte{1}},
+		{DP_TYPE_UINT8, []byte{}},
+		{DP_TYPE_UINT8, []byte{1, 2}},
+		{DP_TYPE_UINT16, []byte{1, 2, 3}},
+		{DP_TYPE_UINT32, []byte{1, 2}},
+		{DP_TYPE_UINT64, []byte{1, 2, 3, 4}},
+		{DP_TYPE_INT8, nil},
+		{DP_TYPE_INT16, []byte{1}},
+		{DP_TYPE_INT32, []byte{1, 2, 3, 4, 5}},
+		{DP_TYPE_INT64, []byte{1, 2, 3, 4, 5, 6, 7}},
+		{DeviceParameterType(0x10), []byte{1}},
+	}
+	for _, test := range decode {
+		if text, err := ParameterValueString(test.dpt, test.value); err == nil {
+			t.Errorf("%s decode %X succeeded with \"%s\"", test.dpt, test.value, text)
+		}
+		if codec, err := LookupCodec(test.dpt); err == nil {
+			if err := codec.Validate(test.value); err == nil {
+				t.Errorf("%s validate %X succeeded", test.dpt, test.value)
+			}
+		}
+	}
+
+	dp := &DeviceParameter{Type: DP_TYPE_UINT16, Value: []byte{1, 2, 3}}
+	if s := dp.String(); s == "[1 2 3]" || s[:6] != "010203" {
+		t.Errorf("unexpected String \"%s\"", s)
+	}
+}
+
+func TestIntegerPrefixes(t *testing.T) {
+	tests := []struct {
+		dpt   DeviceParameterType
+		text  string
+		value []byte
+	}{
+		{DP_TYPE_UINT16, "0x1F40", []byte{0x1F, 0x40}},
+		{DP_TYPE_UINT16, "0X1f40", []byte{0x1F, 0x40}},
+		{DP_TYPE_UINT8, "0b1010", []byte{0x0A}},
+		{DP_TYPE_UINT8, "0o17", []byte{0x0F}},
+		{DP_TYPE_UINT8, "010", []byte{10}}, // Decimal, not octal
+		{DP_TYPE_UINT8, "+5", []byte{5}},
+		{DP_TYPE_INT8, "-0x80", []byte{0x80}},
+		{DP_TYPE_INT16, "-0b10", []byte{0xFF, 0xFE}},
+		{DP_TYPE_UINT64, "0xFFFFFFFFFFFFFFFF", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, test := range tests {
+		if value, err := ParseParameterValue(test.dpt, test.text); err != nil || !bytes.Equal(value, test.value) {
+			t.Errorf("%s encode \"%s\": %X %v", test.dpt, test.text, value, err)
+		}
+	}
+
+	for _, text := range []string{"0x", "0x1FF", "-0x1", "0b102", "0o8", "0y1"} {
+		if value, err := ParseParameterValue(DP_TYPE_UINT8, text); err == nil {
+			t.Errorf("u8 encode \"%s\" succeeded with %X", text, value)
+		}
+	}
+	if value, err := ParseParameterValue(DP_TYPE_INT8, "0xFF"); err == nil {
+		t.Errorf("i8 encode 0xFF succeeded with %X", value)
+	}
+}
+
+func TestValueFormats(t *testing.T) {
+	tests := []struct {
+		dpt    DeviceParameterType
+		value  []byte
+		format ValueFormat
+		text   string
+	}{
+		{DP_TYPE_UINT8, []byte{0x0A}, FormatDecimal, "10"},
+		{DP_TYPE_UINT8, []byte{0x0A}, FormatHex, "0x0A"},
+		{DP_TYPE_UINT8, []byte{0x0A}, FormatBinary, "0b00001010"},
+		{DP_TYPE_UINT16, []byte{0x1F, 0x40}, FormatHex, "0x1F40"},
+		{DP_TYPE_UINT32, []byte{0, 0, 0, 1}, FormatHex, "0x00000001"},
+		{DP_TYPE_INT8, []byte{0x80}, FormatHex, "-0x80"},
+		{DP_TYPE_INT16, []byte{0xFF, 0xFE}, FormatBinary, "-0b0000000000000010"},
+		{DP_TYPE_INT64, []byte{0x80, 0, 0, 0, 0, 0, 0, 0}, FormatHex, "-0x8000000000000000"},
+		{DP_TYPE_STRING, []byte("node"), FormatHex, "node"},
+		{DP_TYPE_RAW, []byte{1, 2}, FormatBinary, "0102"},
+	}
+	for _, test := range tests {
+		text, err := FormatParameterValue(test.dpt, test.value, test.format)
+		if err != nil || text != test.text {
+			t.Errorf("%s %s %X: \"%s\" %v", test.dpt, test.format, test.value, text, err)
+			continue
+		}
+		if value, err := ParseParameterValue(test.dpt, text); err != nil || !bytes.Equal(value, test.value) {
+			t.Errorf("%s \"%s\" does not parse back: %X %v", test.dpt, text, value, err)
+		}
+	}
+
+	for _, name := range []string{"dec", "hex", "bin"} {
+		if format, err := ParseValueFormat(name); err != nil || format.String() != name {
+			t.Errorf("format %s: %s %v", name, format, err)
+		}
+	}
+	if _, err := ParseValueFormat("oct"); err == nil {
+		t.Errorf("oct accepted")
+	}
+}
@@ -0,0 +1,121 @@
+// Author  Raido Pahtma
+// License MIT
+
+package devsim
+
+import "time"
+import "sync"
+import "errors"
+
+import "github.com/proactivity-lab/go-loggers"
+import "github.com/proactivity-lab/go-moteconnection"
+
+// Connection is one end of an in-memory MoteConnection pair, packets sent
+// through one end are dispatched by the other.
+type Connection struct {
+	loggers.DIWEloggers
+
+	mutex       sync.Mutex
+	peer        *Connection
+	dispatchers map[byte]moteconnection.Dispatcher
+	connected   bool
+
+	incoming chan []byte
+	done     chan bool
+}
+
+var _ moteconnection.MoteConnection = (*Connection)(nil)
+
+// Pipe creates a pair of connected connections.
+func Pipe() (*Connection, *Connection) {
+	a := newConnection()
+	b := newConnection()
+	a.peer = b
+	b.peer = a
+	go a.run()
+	go b.run()
+	return a, b
+}
+
+func newConnection() *Connection {
+	c := new(Connection)
+	c.InitLoggers()
+	c.dispatchers = make(map[byte]moteconnection.Dispatcher)
+	c.connected = true
+	c.incoming = make(chan []byte, 256)
+	c.done = make(chan bool)
+	return c
+}
+
+func (c *Connection) Listen() error                    { return nil }
+func (c *Connection) Connect() error                   { return nil }
+func (c *Connection) Autoconnect(period time.Duration) {}
+
+func (c *Connection) Connected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+func (c *Connection) Disconnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.connected {
+		c.connected = false
+		close(c.done)
+	}
+}
+
+func (c *Connection) AddDispatcher(dispatcher moteconnection.Dispatcher) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dispatchers[dispatcher.Dispatch()] = dispatcher
+	return nil
+}
+
+func (c *Connection) RemoveDispatcher(dispatcher moteconnection.Dispatcher) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dispatchers[dispatcher.Dispatch()] == dispatcher {
+		delete(c.dispatchers, dispatcher.Dispatch())
+	}
+	return nil
+}
+
+func (c *Connection) Send(msg moteconnection.Packet) error {
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	if !c.Connected() || !c.peer.Connected() {
+		return errors.New("Not connected")
+	}
+	c.Debug.Printf("SND(%d): %X\n", len(data), data)
+	select {
+	case c.peer.incoming <- data:
+		return nil
+	case <-c.peer.done:
+		return errors.New("Not connected")
+	}
+}
+
+func (c *Connection) run() {
+	for {
+		select {
+		case data := <-c.incoming:
+			c.Debug.Printf("RCV(%d): %X\n", len(data), data)
+			c.mutex.Lock()
+			dispatcher, ok := c.dispatchers[data[0]]
+			c.mutex.Unlock()
+			if ok {
+				if err := dispatcher.Receive(data); err != nil {
+					c.Debug.Printf("Dispatcher error: %s", err)
+				}
+			} else {
+				c.Debug.Printf("No dispatcher for %02X!\n", data[0])
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
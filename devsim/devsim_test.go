@@ -0,0 +1,206 @@
+// Author  Raido Pahtma
+// License MIT
+
+package devsim
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/proactivity-lab/go-moteconnection"
+
+	dp "github.com/thinnect/go-devparam"
+)
+
+func testNode(address moteconnection.AMAddr) *Node {
+	return NewNode(address, 0x0011223300000000|uint64(address),
+		Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{11}},
+		Parameter{Name: "name", Type: dp.DP_TYPE_STRING, Value: []byte("node"), MaxLength: 8},
+		Parameter{Name: "uptime", Type: dp.DP_TYPE_UINT32, Value: []byte{0, 0, 0, 1}, ReadOnly: true})
+}
+
+func testManager(t *testing.T, net *Network, destination moteconnection.AMAddr) *dp.DeviceParameterManager {
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dpm *dp.DeviceParameterManager
+	if destination == 0 {
+		dpm = dp.NewDeviceParameterManager(conn)
+	} else {
+		dpm = dp.NewDeviceParameterActiveMessageManager(conn, 0x22, 0x5678, destination)
+	}
+	dpm.SetTimeout(100 * time.Millisecond)
+	dpm.SetRetries(0)
+	t.Cleanup(func() {
+		dpm.Close()
+		net.Close()
+		conn.Disconnect()
+	})
+	return dpm
+}
+
+func TestActiveMessageNode(t *testing.T) {
+	net := NewNetwork()
+	node := testNode(0x0001)
+	net.AddNode(node)
+	net.AddNode(testNode(0x0002))
+	dpm := testManager(t, net, 0x0001)
+
+	if v, err := dpm.GetValue("radio_channel"); err != nil || !bytes.Equal(v.Value, []byte{11}) || v.Type != dp.DP_TYPE_UINT8 {
+		t.Errorf("get: %v %v", v, err)
+	}
+	if _, err := dpm.SetValue("radio_channel", []byte{15}); err != nil {
+		t.Errorf("set: %v", err)
+	}
+	if v, _ := node.Value("radio_channel"); !bytes.Equal(v, []byte{15}) {
+		t.Errorf("node value %X", v)
+	}
+	if v, _ := net.Node(0x0002).Value("radio_channel"); !bytes.Equal(v, []byte{11}) {
+		t.Errorf("other node changed to %X", v)
+	}
+
+	var missing *dp.ParameterError
+	if _, err := dpm.GetValue("missing"); !errors.As(err, &missing) {
+		t.Errorf("expected ParameterError, got %v", err)
+	}
+	if _, err := dpm.SetValue("radio_channel", []byte{1, 2}); !errors.Is(err, dp.ErrSize) {
+		t.Errorf("expected ESIZE, got %v", err)
+	}
+	if _, err := dpm.SetValue("name", []byte("too long name")); !errors.Is(err, dp.ErrSize) {
+		t.Errorf("expected ESIZE, got %v", err)
+	}
+	if _, err := dpm.SetValue("uptime", []byte{0, 0, 0, 2}); !errors.Is(err, dp.ErrInvalid) {
+		t.Errorf("expected EINVAL, got %v", err)
+	}
+
+	if v, err := dpm.SetValueBySeqnum(1, []byte("renamed")); err != nil || v.Name != "name" {
+		t.Errorf("set by seqnum: %v %v", v, err)
+	}
+
+	pchan, err := dpm.GetList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for p := range pchan {
+		if p.Error != nil {
+			t.Errorf("list: %s", p.Error)
+		}
+		names = append(names, p.Name)
+	}
+	if len(names) != 3 || names[0] != "radio_channel" || names[1] != "name" || names[2] != "uptime" {
+		t.Errorf("unexpected list %v", names)
+	}
+}
+
+func TestSerialNode(t *testing.T) {
+	net := NewNetwork()
+	node := testNode(0x0001)
+	net.SetSerialNode(node)
+	dpm := testManager(t, net, 0)
+
+	if v, err := dpm.GetValue("name"); err != nil || string(v.Value) != "node" {
+		t.Errorf("get: %v %v", v, err)
+	}
+
+	hbs := dpm.SubscribeHeartbeats()
+	net.Heartbeat(0x0001)
+	select {
+	case hb := <-hbs:
+		if hb.Eui64 != node.Eui64 {
+			t.Errorf("unexpected heartbeat %+v", hb)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no heartbeat")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	net := NewNetwork()
+	node := testNode(0x0001)
+	net.AddNode(node)
+	dpm := testManager(t, net, 0x0001)
+
+	node.SetFaults(Faults{Offline: true})
+	var timeout *dp.TimeoutError
+	if _, err := dpm.GetValue("radio_channel"); !errors.As(err, &timeout) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+
+	node.SetFaults(Faults{Delay: 150 * time.Millisecond})
+	if _, err := dpm.GetValue("radio_channel"); !errors.As(err, &timeout) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+	dpm.SetRetries(1) // The late response of the first attempt arrives during the retry
+	if v, err := dpm.GetValue("name"); err != nil || string(v.Value) != "node" {
+		t.Errorf("get: %v %v", v, err)
+	}
+	dpm.SetRetries(0)
+
+	node.SetFaults(Faults{Duplicate: 1})
+	for _, name := range []string{"radio_channel", "name", "radio_channel"} {
+		if v, err := dpm.GetValue(name); err != nil || v.Name != name {
+			t.Errorf("get %s: %v %v", name, v, err)
+		}
+	}
+
+	node.SetFaults(Faults{})
+	node.InjectError("radio_channel", dp.ErrBusy)
+	if _, err := dpm.SetValue("radio_channel", []byte{20}); !errors.Is(err, dp.ErrBusy) {
+		t.Errorf("expected EBUSY, got %v", err)
+	}
+	dpm.SetRetries(1)
+	node.InjectError("radio_channel", dp.ErrBusy)
+	if _, err := dpm.SetValue("radio_channel", []byte{20}); err != nil {
+		t.Errorf("set: %v", err)
+	}
+
+	node.SetFaults(Faults{Drop: 0.5})
+	dpm.SetRetries(20)
+	for i := 0; i < 10; i++ {
+		if _, err := dpm.GetValue("radio_channel"); err != nil {
+			t.Errorf("get: %v", err)
+		}
+	}
+}
+
+func TestReboot(t *testing.T) {
+	net := NewNetwork()
+	node := testNode(0x0001)
+	node.SetUptime(time.Hour)
+	net.AddNode(node)
+	net.AddNode(testNode(0x0002))
+	dpm := testManager(t, net, 0x0001)
+	hbs := dpm.SubscribeHeartbeats()
+
+	heartbeat := func() *dp.DeviceHeartbeat {
+		net.Heartbeat(0x0002) // Must be ignored by the manager
+		net.Heartbeat(0x0001)
+		select {
+		case hb := <-hbs:
+			if hb.Address != 0x0001 {
+				t.Errorf("heartbeat from %s", hb.Address)
+			}
+			return hb
+		case <-time.After(time.Second):
+			t.Fatalf("no heartbeat")
+		}
+		return nil
+	}
+
+	if hb := heartbeat(); hb.Reboot || hb.Uptime < time.Hour {
+		t.Errorf("unexpected heartbeat %+v", hb)
+	}
+
+	dpm.SetValue("radio_channel", []byte{20})
+	node.Reboot()
+	if v, _ := node.Value("radio_channel"); !bytes.Equal(v, []byte{11}) {
+		t.Errorf("default not restored, %X", v)
+	}
+	if hb := heartbeat(); !hb.Reboot {
+		t.Errorf("reboot not detected %+v", hb)
+	}
+}
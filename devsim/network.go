@@ -0,0 +1,312 @@
+// Author  Raido Pahtma
+// License MIT
+
+package devsim
+
+import "fmt"
+import "time"
+import "sync"
+import "errors"
+
+import "github.com/proactivity-lab/go-loggers"
+import "github.com/proactivity-lab/go-moteconnection"
+
+import dp "github.com/thinnect/go-devparam"
+
+// Network hosts simulated nodes and answers the requests that arrive through
+// the connections it has been attached to. ActiveMessage requests are answered
+// by the node with the destination address, raw serial requests by the serial
+// node.
+type Network struct {
+	loggers.DIWEloggers
+
+	mutex       sync.Mutex
+	nodes       map[moteconnection.AMAddr]*Node
+	serial      *Node
+	attachments []*attachment
+	closed      bool
+
+	done chan bool
+}
+
+type attachment struct {
+	conn    moteconnection.MoteConnection
+	amdsp   *moteconnection.MessageDispatcher
+	rawdsp  *moteconnection.PacketDispatcher
+	receive chan moteconnection.Packet
+}
+
+func NewNetwork() *Network {
+	net := new(Network)
+	net.InitLoggers()
+	net.nodes = make(map[moteconnection.AMAddr]*Node)
+	net.done = make(chan bool)
+	return net
+}
+
+func (net *Network) AddNode(node *Node) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	net.nodes[node.Address] = node
+}
+
+func (net *Network) RemoveNode(address moteconnection.AMAddr) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	delete(net.nodes, address)
+}
+
+func (net *Network) Node(address moteconnection.AMAddr) *Node {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	return net.nodes[address]
+}
+
+func (net *Network) Nodes() []*Node {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	nodes := make([]*Node, 0, len(net.nodes))
+	for _, node := range net.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// SetSerialNode sets the node that answers requests arriving without an
+// ActiveMessage header, as a device connected directly to a serial port.
+func (net *Network) SetSerialNode(node *Node) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	net.serial = node
+}
+
+// NewConnection returns an in-memory connection to the network.
+func (net *Network) NewConnection(group moteconnection.AMGroup) (*Connection, error) {
+	client, device := Pipe()
+	if err := net.Attach(device, group); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Attach makes the network answer requests arriving through the connection,
+// the connection may for example be a listening SfConnection.
+func (net *Network) Attach(conn moteconnection.MoteConnection, group moteconnection.AMGroup) error {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	if net.closed {
+		return errors.New("Network has been closed!")
+	}
+
+	a := new(attachment)
+	a.conn = conn
+	a.receive = make(chan moteconnection.Packet)
+	a.amdsp = moteconnection.NewMessageDispatcher(moteconnection.NewMessage(group, 0))
+	a.amdsp.RegisterMessageReceiver(dp.AMID_DEVICE_PARAMETERS, a.receive)
+	a.rawdsp = moteconnection.NewPacketDispatcher(moteconnection.NewRawPacket(dp.TOS_SERIAL_DEVICE_PARAMETERS_ID))
+	a.rawdsp.RegisterReceiver(a.receive)
+
+	if err := conn.AddDispatcher(a.amdsp); err != nil {
+		return err
+	}
+	if err := conn.AddDispatcher(a.rawdsp); err != nil {
+		return err
+	}
+	net.attachments = append(net.attachments, a)
+
+	go net.serve(a)
+	return nil
+}
+
+func (net *Network) serve(a *attachment) {
+	for {
+		select {
+		case packet := <-a.receive:
+			net.received(a, packet)
+		case <-net.done:
+			return
+		}
+	}
+}
+
+func (net *Network) received(a *attachment, packet moteconnection.Packet) {
+	net.Debug.Printf("%s\n", packet)
+	switch p := packet.(type) {
+	case *moteconnection.Message:
+		for _, node := range net.targets(p.Destination()) {
+			if response := node.handle(p.GetPayload()); response != nil {
+				msg := a.amdsp.NewMessage()
+				msg.SetSource(node.Address)
+				msg.SetDestination(p.Source())
+				msg.SetGroup(p.Group())
+				msg.SetType(dp.AMID_DEVICE_PARAMETERS)
+				msg.SetPayload(response)
+				net.respond(a, node, msg)
+			}
+		}
+	case *moteconnection.RawPacket:
+		net.mutex.Lock()
+		node := net.serial
+		net.mutex.Unlock()
+		if node != nil {
+			if response := node.handle(p.GetPayload()); response != nil {
+				msg := a.rawdsp.NewPacket()
+				msg.SetPayload(response)
+				net.respond(a, node, msg)
+			}
+		}
+	}
+}
+
+func (net *Network) targets(destination moteconnection.AMAddr) []*Node {
+	if destination == 0xFFFF {
+		return net.Nodes()
+	}
+	if node := net.Node(destination); node != nil {
+		return []*Node{node}
+	}
+	return nil
+}
+
+func (net *Network) respond(a *attachment, node *Node, msg moteconnection.Packet) {
+	for _, delay := range node.delays() {
+		if delay == 0 {
+			net.send(a, msg)
+		} else {
+			go func(delay time.Duration) {
+				select {
+				case <-time.After(delay):
+					net.send(a, msg)
+				case <-net.done:
+				}
+			}(delay)
+		}
+	}
+}
+
+func (net *Network) send(a *attachment, msg moteconnection.Packet) {
+	if err := a.conn.Send(msg); err != nil {
+		net.Debug.Printf("Send failed: %s\n", err)
+	}
+}
+
+// Heartbeat makes the node broadcast a heartbeat on all attached connections.
+func (net *Network) Heartbeat(address moteconnection.AMAddr) error {
+	node, err := net.sender(address)
+	if err != nil {
+		return err
+	}
+	if node.Faults().Offline {
+		return nil
+	}
+
+	net.broadcast(node, node.heartbeat())
+	return nil
+}
+
+// Report makes the node broadcast the current value of a parameter on all
+// attached connections, as devices do after a local change.
+func (net *Network) Report(address moteconnection.AMAddr, name string) error {
+	node, err := net.sender(address)
+	if err != nil {
+		return err
+	}
+	payload, err := node.report(name)
+	if err != nil {
+		return err
+	}
+	if node.Faults().Offline {
+		return nil
+	}
+
+	net.broadcast(node, payload)
+	return nil
+}
+
+func (net *Network) sender(address moteconnection.AMAddr) (*Node, error) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	if node := net.nodes[address]; node != nil {
+		return node, nil
+	}
+	if net.serial != nil && net.serial.Address == address {
+		return net.serial, nil
+	}
+	return nil, errors.New(fmt.Sprintf("No node %s in network!", address))
+}
+
+// broadcast sends a payload from the node on all attached connections.
+func (net *Network) broadcast(node *Node, payload []byte) {
+	net.mutex.Lock()
+	serial := net.serial
+	attachments := append([]*attachment(nil), net.attachments...)
+	net.mutex.Unlock()
+
+	for _, a := range attachments {
+		if node == serial {
+			msg := a.rawdsp.NewPacket()
+			msg.SetPayload(payload)
+			net.send(a, msg)
+		} else {
+			msg := a.amdsp.NewMessage()
+			msg.SetSource(node.Address)
+			msg.SetDestination(0xFFFF)
+			msg.SetType(dp.AMID_DEVICE_PARAMETERS)
+			msg.SetPayload(payload)
+			net.send(a, msg)
+		}
+	}
+}
+
+// StartHeartbeats makes all nodes broadcast heartbeats periodically until the
+// network is closed.
+func (net *Network) StartHeartbeats(period time.Duration) {
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				net.mutex.Lock()
+				addresses := make([]moteconnection.AMAddr, 0, len(net.nodes)+1)
+				for address := range net.nodes {
+					addresses = append(addresses, address)
+				}
+				if net.serial != nil && net.nodes[net.serial.Address] != net.serial {
+					addresses = append(addresses, net.serial.Address)
+				}
+				net.mutex.Unlock()
+
+				for _, address := range addresses {
+					net.Heartbeat(address)
+				}
+			case <-net.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops answering requests and removes the dispatchers from the
+// attached connections.
+func (net *Network) Close() error {
+	net.mutex.Lock()
+	if net.closed {
+		net.mutex.Unlock()
+		return errors.New("Close has already been called!")
+	}
+	net.closed = true
+	attachments := net.attachments
+	net.mutex.Unlock()
+
+	// Requests are served until the dispatchers have been removed, so that the
+	// connections can not get stuck on delivery.
+	for _, a := range attachments {
+		a.conn.RemoveDispatcher(a.amdsp)
+		a.conn.RemoveDispatcher(a.rawdsp)
+	}
+	close(net.done)
+	return nil
+}
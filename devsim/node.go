@@ -0,0 +1,291 @@
+// Author  Raido Pahtma
+// License MIT
+
+// Package devsim simulates devices that implement the deviceparameters
+// protocol, so that managers, the director and applications can be exercised
+// without real hardware.
+package devsim
+
+import "fmt"
+import "time"
+import "sync"
+import "errors"
+import "math/rand"
+
+import "github.com/proactivity-lab/go-moteconnection"
+
+import dp "github.com/thinnect/go-devparam"
+
+type Parameter struct {
+	Name      string
+	Type      dp.DeviceParameterType
+	Value     []byte
+	ReadOnly  bool // Set requests are answered with EINVAL
+	MaxLength int  // Maximum length of raw and str values, 0 for no limit
+
+	Clamp func(value []byte) []byte // Optional, adjusts values before they are stored
+}
+
+// Faults describes how unreliable the communication with a node is.
+type Faults struct {
+	Offline   bool          // Nothing is answered
+	Drop      float64       // Probability of losing a request and, separately, a response
+	Duplicate float64       // Probability of a response being delivered twice
+	Delay     time.Duration // Delay before responding
+	Jitter    time.Duration // Random additional delay, responses may get reordered
+}
+
+type Node struct {
+	Address moteconnection.AMAddr
+	Eui64   uint64
+
+	mutex      sync.Mutex
+	defaults   []Parameter
+	parameters []*Parameter
+	boot       time.Time
+	injected   map[string][]dp.DeviceErrorCode
+	faults     Faults
+	random     *rand.Rand
+	requests   int
+}
+
+func NewNode(address moteconnection.AMAddr, eui64 uint64, parameters ...Parameter) *Node {
+	node := new(Node)
+	node.Address = address
+	node.Eui64 = eui64
+	node.defaults = parameters
+	node.injected = make(map[string][]dp.DeviceErrorCode)
+	node.random = rand.New(rand.NewSource(int64(eui64) ^ int64(address)))
+	node.reset()
+	return node
+}
+
+func (node *Node) reset() {
+	node.parameters = make([]*Parameter, len(node.defaults))
+	for i, p := range node.defaults {
+		param := p
+		param.Value = append([]byte(nil), p.Value...)
+		node.parameters[i] = &param
+	}
+	node.boot = time.Now()
+}
+
+func (node *Node) SetFaults(faults Faults) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.faults = faults
+}
+
+func (node *Node) Faults() Faults {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.faults
+}
+
+// InjectError makes the node answer the next requests for the parameter with
+// the given error codes, one code per request.
+func (node *Node) InjectError(name string, codes ...dp.DeviceErrorCode) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.injected[name] = append(node.injected[name], codes...)
+}
+
+// Reboot restores the default parameter values and restarts the uptime.
+func (node *Node) Reboot() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.reset()
+}
+
+// SetUptime moves the boot time of the node, so that it appears to have been
+// running for the given duration.
+func (node *Node) SetUptime(uptime time.Duration) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.boot = time.Now().Add(-uptime)
+}
+
+func (node *Node) Uptime() time.Duration {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return time.Since(node.boot)
+}
+
+// Requests returns the number of requests the node has received.
+func (node *Node) Requests() int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.requests
+}
+
+func (node *Node) Parameters() []Parameter {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	params := make([]Parameter, len(node.parameters))
+	for i, p := range node.parameters {
+		params[i] = *p
+		params[i].Value = append([]byte(nil), p.Value...)
+	}
+	return params
+}
+
+func (node *Node) Value(name string) ([]byte, bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if _, p := node.lookup(name); p != nil {
+		return append([]byte(nil), p.Value...), true
+	}
+	return nil, false
+}
+
+// SetValue changes a value locally on the node, as if it was changed by the
+// firmware itself.
+func (node *Node) SetValue(name string, value []byte) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if _, p := node.lookup(name); p != nil {
+		p.Value = append([]byte(nil), value...)
+		return nil
+	}
+	return errors.New(fmt.Sprintf("No parameter \"%s\" on node %s!", name, node.Address))
+}
+
+func (node *Node) lookup(name string) (uint8, *Parameter) {
+	for i, p := range node.parameters {
+		if p.Name == name {
+			return uint8(i), p
+		}
+	}
+	return 0, nil
+}
+
+func (node *Node) heartbeat() []byte {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return moteconnection.SerializePacket(&dp.DpHeartbeat{Header: dp.DP_HEARTBEAT, Eui64: node.Eui64, Uptime: uint32(time.Since(node.boot) / time.Second)})
+}
+
+func (node *Node) report(name string) ([]byte, error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if seqnum, p := node.lookup(name); p != nil {
+		return parameterPacket(seqnum, p), nil
+	}
+	return nil, errors.New(fmt.Sprintf("No parameter \"%s\" on node %s!", name, node.Address))
+}
+
+func (node *Node) chance(probability float64) bool {
+	return probability > 0 && node.random.Float64() < probability
+}
+
+// delays returns the delays for sending the responses to a request, no
+// response is sent if the list is empty.
+func (node *Node) delays() []time.Duration {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if node.chance(node.faults.Drop) {
+		return nil
+	}
+	delays := []time.Duration{node.delay()}
+	if node.chance(node.faults.Duplicate) {
+		delays = append(delays, node.delay())
+	}
+	return delays
+}
+
+func (node *Node) delay() time.Duration {
+	d := node.faults.Delay
+	if node.faults.Jitter > 0 {
+		d += time.Duration(node.random.Int63n(int64(node.faults.Jitter)))
+	}
+	return d
+}
+
+// handle processes a request and returns the response, nil if the request is
+// not answered.
+func (node *Node) handle(payload []byte) []byte {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if node.faults.Offline || len(payload) == 0 || node.chance(node.faults.Drop) {
+		return nil
+	}
+	node.requests++
+
+	switch payload[0] {
+	case dp.DP_GET_PARAMETER_WITH_ID:
+		p := new(dp.DpGetParameterId)
+		if moteconnection.DeserializePacket(p, payload) == nil {
+			seqnum, param := node.lookup(p.Id)
+			return node.respondId(p.Id, seqnum, param, false, nil)
+		}
+	case dp.DP_SET_PARAMETER_WITH_ID:
+		p := new(dp.DpSetParameterId)
+		if moteconnection.DeserializePacket(p, payload) == nil {
+			seqnum, param := node.lookup(p.Id)
+			return node.respondId(p.Id, seqnum, param, true, p.Value)
+		}
+	case dp.DP_GET_PARAMETER_WITH_SEQNUM:
+		p := new(dp.DpGetParameterSeqnum)
+		if moteconnection.DeserializePacket(p, payload) == nil {
+			return node.respondSeqnum(p.Seqnum, false, nil)
+		}
+	case dp.DP_SET_PARAMETER_WITH_SEQNUM:
+		p := new(dp.DpSetParameterSeqnum)
+		if moteconnection.DeserializePacket(p, payload) == nil {
+			return node.respondSeqnum(p.Seqnum, true, p.Value)
+		}
+	}
+	return nil
+}
+
+func (node *Node) respondId(name string, seqnum uint8, param *Parameter, set bool, value []byte) []byte {
+	if param == nil {
+		return moteconnection.SerializePacket(&dp.DpErrorParameterId{Header: dp.DP_ERROR_PARAMETER_ID, Exists: false, Id: name})
+	}
+	if code := node.access(param, set, value); code != 0 {
+		return moteconnection.SerializePacket(&dp.DpErrorParameterId{Header: dp.DP_ERROR_PARAMETER_ID, Exists: true, Err: uint8(code), Id: name})
+	}
+	return parameterPacket(seqnum, param)
+}
+
+func (node *Node) respondSeqnum(seqnum uint8, set bool, value []byte) []byte {
+	if int(seqnum) >= len(node.parameters) {
+		return moteconnection.SerializePacket(&dp.DpErrorParameterSeqnum{Header: dp.DP_ERROR_PARAMETER_SEQNUM, Exists: false, Seqnum: seqnum})
+	}
+	param := node.parameters[seqnum]
+	if code := node.access(param, set, value); code != 0 {
+		return moteconnection.SerializePacket(&dp.DpErrorParameterSeqnum{Header: dp.DP_ERROR_PARAMETER_SEQNUM, Exists: true, Err: uint8(code), Seqnum: seqnum})
+	}
+	return parameterPacket(seqnum, param)
+}
+
+// access applies injected errors and stores the value for set requests,
+// returns the error code for the response or 0 on success.
+func (node *Node) access(param *Parameter, set bool, value []byte) dp.DeviceErrorCode {
+	if codes := node.injected[param.Name]; len(codes) > 0 {
+		node.injected[param.Name] = codes[1:]
+		return codes[0]
+	}
+	if set {
+		if param.ReadOnly {
+			return dp.ErrInvalid
+		}
+		if size := param.Type.Size(); size > 0 && len(value) != size {
+			return dp.ErrSize
+		}
+		if param.MaxLength > 0 && len(value) > param.MaxLength {
+			return dp.ErrSize
+		}
+		if param.Clamp != nil {
+			value = param.Clamp(value)
+		}
+		param.Value = append([]byte(nil), value...)
+	}
+	return 0
+}
+
+func parameterPacket(seqnum uint8, param *Parameter) []byte {
+	return moteconnection.SerializePacket(&dp.DpParameter{Header: dp.DP_PARAMETER, Type: uint8(param.Type), Seqnum: seqnum, Id: param.Name, Value: param.Value})
+}
@@ -0,0 +1,117 @@
+// Author  Raido Pahtma
+// License MIT
+
+package devsim
+
+import "os"
+import "io"
+import "fmt"
+import "bufio"
+import "errors"
+import "strings"
+import "path/filepath"
+import "encoding/csv"
+import "encoding/json"
+
+import dp "github.com/thinnect/go-devparam"
+
+// tableEntry is the JSON representation of a Parameter.
+type tableEntry struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	ReadOnly  bool   `json:"readonly,omitempty"`
+	MaxLength int    `json:"maxlength,omitempty"`
+}
+
+// ReadParameterTable loads a parameter table from a JSON or CSV file, the
+// format is chosen based on the file extension.
+//
+// JSON tables are a list of objects with the fields name, type, value and the
+// optional readonly and maxlength. CSV tables have the columns
+// name, type, value, flags, where flags may contain "ro" for read-only
+// parameters and "max=N" for limiting the length of raw and str values. Lines
+// beginning with # are ignored in CSV tables. Values are given in the same
+// format as in deviceparameters task files.
+func ReadParameterTable(path string) ([]Parameter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []tableEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.NewDecoder(bufio.NewReader(f)).Decode(&entries); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+		}
+	case ".csv":
+		if entries, err = readCSVTable(f); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: unsupported parameter table format!", path))
+	}
+
+	params := make([]Parameter, 0, len(entries))
+	for _, e := range entries {
+		p, err := e.parameter()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+func readCSVTable(r io.Reader) ([]tableEntry, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	entries := make([]tableEntry, 0)
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 && len(line) > 1 && line[0] == "name" && line[1] == "type" {
+			continue // found the header
+		}
+		if len(line) < 3 {
+			return nil, errors.New(fmt.Sprintf("'%s' does not have name, type and value!", strings.Join(line, ",")))
+		}
+
+		e := tableEntry{Name: line[0], Type: line[1], Value: line[2]}
+		if len(line) > 3 {
+			for _, flag := range strings.Fields(line[3]) {
+				if flag == "ro" {
+					e.ReadOnly = true
+				} else if _, err := fmt.Sscanf(flag, "max=%d", &e.MaxLength); err != nil {
+					return nil, errors.New(fmt.Sprintf("'%s' is not a valid flag!", flag))
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (e *tableEntry) parameter() (Parameter, error) {
+	if len(e.Name) == 0 || len(e.Name) > 16 {
+		return Parameter{}, errors.New(fmt.Sprintf("'%s' is not a valid parameter name!", e.Name))
+	}
+	t, err := dp.ParseDeviceParameterType(e.Type)
+	if err != nil {
+		return Parameter{}, err
+	}
+	v, err := dp.ParseParameterValue(t, e.Value)
+	if err != nil {
+		return Parameter{}, errors.New(fmt.Sprintf("'%s' is not a valid %s value!", e.Value, t))
+	}
+	return Parameter{Name: e.Name, Type: t, Value: v, ReadOnly: e.ReadOnly, MaxLength: e.MaxLength}, nil
+}
@@ -0,0 +1,52 @@
+// Author  Raido Pahtma
+// License MIT
+
+package devsim
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dp "github.com/thinnect/go-devparam"
+)
+
+func TestReadParameterTable(t *testing.T) {
+	dir := t.TempDir()
+	tables := map[string]string{
+		"params.csv": "name,type,value,flags\n# comment\nradio_channel,u8,11,\nname,str,node,max=8\nuptime,u32,1,ro\n",
+		"params.json": `[{"name": "radio_channel", "type": "u8", "value": "11"},
+			{"name": "name", "type": "str", "value": "node", "maxlength": 8},
+			{"name": "uptime", "type": "u32", "value": "1", "readonly": true}]`,
+	}
+
+	for file, content := range tables {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		params, err := ReadParameterTable(path)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		if len(params) != 3 {
+			t.Fatalf("%s: %d parameters", file, len(params))
+		}
+		if p := params[0]; p.Name != "radio_channel" || p.Type != dp.DP_TYPE_UINT8 || !bytes.Equal(p.Value, []byte{11}) {
+			t.Errorf("%s: unexpected %+v", file, p)
+		}
+		if p := params[1]; p.MaxLength != 8 || string(p.Value) != "node" {
+			t.Errorf("%s: unexpected %+v", file, p)
+		}
+		if p := params[2]; !p.ReadOnly || !bytes.Equal(p.Value, []byte{0, 0, 0, 1}) {
+			t.Errorf("%s: unexpected %+v", file, p)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.csv")
+	os.WriteFile(bad, []byte("radio_channel,u8,300\n"), 0644)
+	if _, err := ReadParameterTable(bad); err == nil {
+		t.Errorf("invalid value accepted")
+	}
+}
@@ -0,0 +1,374 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "os"
+import "fmt"
+import "path"
+import "sort"
+import "errors"
+import "strconv"
+import "strings"
+import "path/filepath"
+import "encoding/json"
+
+import "gopkg.in/yaml.v3"
+
+import "github.com/proactivity-lab/go-moteconnection"
+
+import dp "github.com/thinnect/go-devparam"
+
+// DesiredState declares the parameter values of nodes by groups. A node
+// belongs to a group if it matches any of the selectors of the group, groups
+// without selectors only serve as a base for other groups. The parameters of
+// all groups of a node are combined in the order the groups are listed, later
+// groups override earlier ones and the parameters of the node itself override
+// all groups.
+type DesiredState struct {
+	Description string        `json:"description,omitempty" yaml:"description,omitempty"`
+	Groups      []*NodeGroup  `json:"groups" yaml:"groups"`
+	Nodes       []*NodeConfig `json:"nodes,omitempty" yaml:"nodes,omitempty"`
+
+	groups map[string]*NodeGroup
+}
+
+// NodeGroup selects nodes by address ranges like "0100-01FF", addresses, an
+// EUI-64 pattern like "70B3D5E39*" and tags. The group starts with the
+// parameters of the groups it inherits from, in the listed order.
+type NodeGroup struct {
+	Name       string             `json:"name" yaml:"name"`
+	Inherit    []string           `json:"inherit,omitempty" yaml:"inherit,omitempty"`
+	Ranges     []string           `json:"ranges,omitempty" yaml:"ranges,omitempty"`
+	Nodes      []string           `json:"nodes,omitempty" yaml:"nodes,omitempty"`
+	Eui64      string             `json:"eui64,omitempty" yaml:"eui64,omitempty"`
+	Tags       []string           `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Parameters []DesiredParameter `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+
+	ranges [][2]moteconnection.AMAddr
+	nodes  map[moteconnection.AMAddr]bool
+}
+
+// NodeConfig describes a known node, its tags and the parameters that
+// override the values from the groups.
+type NodeConfig struct {
+	Address    string             `json:"address" yaml:"address"`
+	Eui64      string             `json:"eui64,omitempty" yaml:"eui64,omitempty"`
+	Tags       []string           `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Parameters []DesiredParameter `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+
+	address moteconnection.AMAddr
+	eui64   uint64
+}
+
+// DesiredParameter is a parameter value, an empty value only queries the
+// parameter. The type may be left out if it is given by the schema or by the
+// group that the value overrides.
+type DesiredParameter struct {
+	Name  string `json:"name" yaml:"name"`
+	Type  string `json:"type,omitempty" yaml:"type,omitempty"`
+	Value text   `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// NodeInfo is what is known about a node when its groups are determined,
+// Eui64 is 0 if it is not known.
+type NodeInfo struct {
+	Address moteconnection.AMAddr
+	Eui64   uint64
+	Tags    []string
+}
+
+// ReadDesiredState loads the desired state from a JSON or YAML file, the
+// format is chosen based on the file extension.
+func ReadDesiredState(path string) (*DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := new(DesiredState)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, state)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, state)
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: unsupported desired state format!", path))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+
+	if err := state.Init(); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	return state, nil
+}
+
+// Init checks the desired state and prepares it for use, it must be called
+// when a DesiredState is constructed or modified without ReadDesiredState.
+func (state *DesiredState) Init() error {
+	state.groups = make(map[string]*NodeGroup)
+	for _, g := range state.Groups {
+		if len(g.Name) == 0 {
+			return errors.New("Group without a name!")
+		}
+		if _, ok := state.groups[g.Name]; ok {
+			return errors.New(fmt.Sprintf("Group \"%s\" is listed more than once!", g.Name))
+		}
+		if err := g.init(); err != nil {
+			return errors.New(fmt.Sprintf("Group \"%s\": %s", g.Name, err))
+		}
+		state.groups[g.Name] = g
+	}
+	for _, g := range state.Groups {
+		if err := state.checkInheritance(g, nil); err != nil {
+			return err
+		}
+	}
+
+	addresses := make(map[moteconnection.AMAddr]bool)
+	for _, n := range state.Nodes {
+		if err := n.init(); err != nil {
+			return errors.New(fmt.Sprintf("Node \"%s\": %s", n.Address, err))
+		}
+		if addresses[n.address] {
+			return errors.New(fmt.Sprintf("Node %s is listed more than once!", n.address))
+		}
+		addresses[n.address] = true
+	}
+	return nil
+}
+
+func (g *NodeGroup) init() error {
+	g.ranges = make([][2]moteconnection.AMAddr, 0, len(g.Ranges))
+	for _, r := range g.Ranges {
+		bounds := strings.SplitN(r, "-", 2)
+		if len(bounds) != 2 {
+			return errors.New(fmt.Sprintf("'%s' is not a valid address range!", r))
+		}
+		first, err := parseAddress(bounds[0])
+		if err != nil {
+			return err
+		}
+		last, err := parseAddress(bounds[1])
+		if err != nil {
+			return err
+		}
+		if last < first {
+			return errors.New(fmt.Sprintf("'%s' is not a valid address range!", r))
+		}
+		g.ranges = append(g.ranges, [2]moteconnection.AMAddr{first, last})
+	}
+
+	g.nodes = make(map[moteconnection.AMAddr]bool)
+	for _, n := range g.Nodes {
+		addr, err := parseAddress(n)
+		if err != nil {
+			return err
+		}
+		g.nodes[addr] = true
+	}
+
+	if _, err := path.Match(strings.ToUpper(g.Eui64), ""); err != nil {
+		return errors.New(fmt.Sprintf("'%s' is not a valid EUI-64 pattern!", g.Eui64))
+	}
+	return checkParameters(g.Parameters)
+}
+
+func (n *NodeConfig) init() error {
+	var err error
+	if n.address, err = parseAddress(n.Address); err != nil {
+		return err
+	}
+	n.eui64 = 0
+	if len(n.Eui64) > 0 {
+		if n.eui64, err = strconv.ParseUint(n.Eui64, 16, 64); err != nil {
+			return errors.New(fmt.Sprintf("'%s' is not a valid EUI-64!", n.Eui64))
+		}
+	}
+	return checkParameters(n.Parameters)
+}
+
+func parseAddress(s string) (moteconnection.AMAddr, error) {
+	addr, err := strconv.ParseUint(strings.TrimSpace(s), 16, 16)
+	if err != nil || addr == 0 || addr == 0xFFFF {
+		return 0, errors.New(fmt.Sprintf("'%s' is not a valid address!", s))
+	}
+	return moteconnection.AMAddr(addr), nil
+}
+
+func checkParameters(params []DesiredParameter) error {
+	names := make(map[string]bool)
+	for _, p := range params {
+		if len(p.Name) == 0 || len(p.Name) > 16 {
+			return errors.New(fmt.Sprintf("'%s' is not a valid parameter name!", p.Name))
+		}
+		if names[p.Name] {
+			return errors.New(fmt.Sprintf("Parameter \"%s\" is listed more than once!", p.Name))
+		}
+		names[p.Name] = true
+		if len(p.Type) > 0 {
+			if _, err := dp.ParseDeviceParameterType(p.Type); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkInheritance looks for unknown groups and loops in the inheritance.
+func (state *DesiredState) checkInheritance(g *NodeGroup, chain []string) error {
+	for _, name := range chain {
+		if name == g.Name {
+			return errors.New(fmt.Sprintf("Group \"%s\" inherits from itself!", g.Name))
+		}
+	}
+	for _, name := range g.Inherit {
+		parent, ok := state.groups[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("Group \"%s\" inherits from unknown group \"%s\"!", g.Name, name))
+		}
+		if err := state.checkInheritance(parent, append(chain, g.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Node returns the configuration of the node, nil if the node is not listed.
+func (state *DesiredState) Node(addr moteconnection.AMAddr) *NodeConfig {
+	for _, n := range state.Nodes {
+		if n.address == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// Known returns the nodes that are listed in the desired state, either in the
+// nodes section or by address in a group, ordered by address.
+func (state *DesiredState) Known() []NodeInfo {
+	nodes := make(map[moteconnection.AMAddr]NodeInfo)
+	for _, g := range state.Groups {
+		for addr := range g.nodes {
+			nodes[addr] = NodeInfo{Address: addr}
+		}
+	}
+	for _, n := range state.Nodes {
+		nodes[n.address] = NodeInfo{Address: n.address, Eui64: n.eui64, Tags: n.Tags}
+	}
+
+	known := make([]NodeInfo, 0, len(nodes))
+	for _, info := range nodes {
+		known = append(known, info)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i].Address < known[j].Address })
+	return known
+}
+
+// matches reports if the node is selected by the group.
+func (g *NodeGroup) matches(node NodeInfo) bool {
+	if g.nodes[node.Address] {
+		return true
+	}
+	for _, r := range g.ranges {
+		if r[0] <= node.Address && node.Address <= r[1] {
+			return true
+		}
+	}
+	if len(g.Eui64) > 0 && node.Eui64 != 0 {
+		if ok, _ := path.Match(strings.ToUpper(g.Eui64), fmt.Sprintf("%016X", node.Eui64)); ok {
+			return true
+		}
+	}
+	for _, tag := range g.Tags {
+		for _, t := range node.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// info completes what is known about the node with its configuration.
+func (state *DesiredState) info(node NodeInfo) NodeInfo {
+	if n := state.Node(node.Address); n != nil {
+		if node.Eui64 == 0 {
+			node.Eui64 = n.eui64
+		}
+		node.Tags = append(append([]string(nil), n.Tags...), node.Tags...)
+	}
+	return node
+}
+
+// Membership returns the names of the groups the node belongs to.
+func (state *DesiredState) Membership(node NodeInfo) []string {
+	node = state.info(node)
+	groups := make([]string, 0)
+	for _, g := range state.Groups {
+		if g.matches(node) {
+			groups = append(groups, g.Name)
+		}
+	}
+	return groups
+}
+
+// parameterSet keeps the parameters in the order they were first declared.
+type parameterSet struct {
+	params  []DesiredParameter
+	sources []string
+	index   map[string]int
+}
+
+func (set *parameterSet) add(p DesiredParameter, source string) {
+	if i, ok := set.index[p.Name]; ok {
+		if len(p.Type) == 0 { // An override may only give the value
+			p.Type = set.params[i].Type
+		}
+		set.params[i] = p
+		set.sources[i] = source
+		return
+	}
+	set.index[p.Name] = len(set.params)
+	set.params = append(set.params, p)
+	set.sources = append(set.sources, source)
+}
+
+func (state *DesiredState) addGroup(set *parameterSet, g *NodeGroup) {
+	for _, name := range g.Inherit {
+		state.addGroup(set, state.groups[name])
+	}
+	for _, p := range g.Parameters {
+		set.add(p, g.Name)
+	}
+}
+
+// Compile returns the tasks of the node in text form. The group that a value
+// comes from is recorded in the "group" field, "node" if the value is from the
+// node configuration, and a known EUI-64 in the "eui64" field.
+func (state *DesiredState) Compile(node NodeInfo) []TaskRecord {
+	node = state.info(node)
+	set := &parameterSet{index: make(map[string]int)}
+	for _, g := range state.Groups {
+		if g.matches(node) {
+			state.addGroup(set, g)
+		}
+	}
+	if n := state.Node(node.Address); n != nil {
+		for _, p := range n.Parameters {
+			set.add(p, "node")
+		}
+	}
+
+	records := make([]TaskRecord, len(set.params))
+	for i, p := range set.params {
+		records[i] = TaskRecord{Address: node.Address.String(), Parameter: p.Name, Type: p.Type, Desired: string(p.Value),
+			Meta: map[string]string{"group": set.sources[i]}}
+		if node.Eui64 != 0 {
+			records[i].Meta["eui64"] = fmt.Sprintf("%016X", node.Eui64)
+		}
+	}
+	return records
+}
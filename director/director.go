@@ -4,18 +4,18 @@
 package director
 
 import "os"
-import "io"
 import "bufio"
+import "context"
 
 import "fmt"
 import "time"
 import "strconv"
 import "strings"
+import "sync"
+import "encoding/hex"
 
 import "errors"
 
-import "encoding/csv"
-
 import "github.com/proactivity-lab/go-loggers"
 import "github.com/proactivity-lab/go-moteconnection"
 
@@ -28,9 +28,35 @@ type DeviceParameterTask struct {
 	Desired   []byte
 	Actual    []byte
 	Info      string
+	Comment   string            // Free-form comment from the task file
+	Meta      map[string]string // Additional fields from the task file
 
 	Disabled bool // Has been commented out
 	Blocked  bool // Something wrong with it
+	Verify   bool // Completed, but the value must be read again
+}
+
+// setMeta sets an additional field, an empty value removes it. The fields are
+// copied, as the map is shared with the copy of the task in the task list.
+func (task *DeviceParameterTask) setMeta(name string, value string) {
+	meta := make(map[string]string)
+	for k, v := range task.Meta {
+		if k != name {
+			meta[k] = v
+		}
+	}
+	if len(value) > 0 {
+		meta[name] = value
+	}
+	if len(meta) == 0 {
+		meta = nil
+	}
+	task.Meta = meta
+}
+
+// pending reports if the task still needs to be worked on.
+func (task *DeviceParameterTask) pending() bool {
+	return task.Disabled == false && task.Blocked == false && (task.Actual == nil || task.Verify)
 }
 
 type DeviceParameterDirector struct {
@@ -41,14 +67,34 @@ type DeviceParameterDirector struct {
 	address moteconnection.AMAddr
 	//dsp  moteconnection.Dispatcher
 
-	timeout time.Duration
-	retries uint8
+	timeout     time.Duration
+	retries     uint8
+	format      dp.ValueFormat
+	schema      *dp.Schema
+	concurrency int
+	mismatch    MismatchPolicy
+	verify      bool
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	listen      time.Duration
 
 	filepath string
+	list     TaskList // Comment and field order of the task file, tasks are kept separately
 
+	mutex sync.Mutex // Guards tasks, stats and the file when several nodes are processed
 	tasks []DeviceParameterTask
+	stats map[moteconnection.AMAddr]*NodeStatistics
+
+	wakeup chan bool // Signalled when a node that has been backed off is heard from
+
+	desired *DesiredState                      // Tasks are added for nodes that join the groups
+	members map[moteconnection.AMAddr]NodeInfo // Nodes known to the desired state
+	stale   map[moteconnection.AMAddr]bool     // Nodes whose groups may have changed
+	started time.Time
 
 	interrupt chan bool
+	ctx       context.Context // Cancelled by Stop, so that requests in progress are not waited for
+	cancel    context.CancelFunc
 	done      chan bool
 }
 
@@ -71,14 +117,22 @@ func NewDeviceParameterDirector(conn moteconnection.MoteConnection,
 	opts ...option) (*DeviceParameterDirector, error) {
 
 	dpd := new(DeviceParameterDirector)
+	dpd.InitLoggers()
 	dpd.conn = conn
 	dpd.group = group
 	dpd.address = address
 
 	dpd.timeout = 30 * time.Second
 	dpd.retries = 2
+	dpd.concurrency = 1
+	dpd.backoffMin = 10 * time.Second
+	dpd.backoffMax = 10 * time.Minute
+
+	dpd.stats = make(map[moteconnection.AMAddr]*NodeStatistics)
+	dpd.wakeup = make(chan bool, 1)
 
 	dpd.interrupt = make(chan bool)
+	dpd.ctx, dpd.cancel = context.WithCancel(context.Background())
 
 	for _, opt := range opts {
 		_, err := opt(dpd)
@@ -106,15 +160,71 @@ func Retries(r uint8) option {
 	}
 }
 
+// Concurrency sets the number of nodes that are worked on simultaneously, the
+// tasks of a single node are still executed one by one in the listed order.
+func Concurrency(n int) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		if n < 1 {
+			return Concurrency(dpd.concurrency), errors.New(fmt.Sprintf("Concurrency must be at least 1, not %d!", n))
+		}
+		previous := dpd.concurrency
+		dpd.concurrency = n
+		return Concurrency(previous), nil
+	}
+}
+
+// Format sets how integer values are written to the task file.
+func Format(f dp.ValueFormat) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		previous := dpd.format
+		dpd.format = f
+		return Format(previous), nil
+	}
+}
+
+// Schema makes the director validate tasks against the schema and use the
+// presentations from the schema for values in the task file.
+func Schema(s *dp.Schema) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		previous := dpd.schema
+		dpd.schema = s
+		return Schema(previous), nil
+	}
+}
+
 func (task *DeviceParameterTask) ToCSV() []string {
+	return task.ToCSVFormat(dp.FormatDecimal)
+}
+
+func (task *DeviceParameterTask) ToCSVFormat(format dp.ValueFormat) []string {
+	return task.toCSV(func(value []byte) string {
+		return formatValue(task.Type, value, format)
+	})
+}
+
+// rawPrefix marks values that the type of the task can not present, for
+// example values of the wrong length, the bytes are given in hex.
+const rawPrefix = "raw:"
+
+// formatValue presents the value, falling back to hex so that values that do
+// not match the type are not lost.
+func formatValue(dpt dp.DeviceParameterType, value []byte, format dp.ValueFormat) string {
+	s, err := dp.FormatParameterValue(dpt, value, format)
+	if err != nil {
+		return fmt.Sprintf("%s%X", rawPrefix, value)
+	}
+	return s
+}
+
+func (task *DeviceParameterTask) toCSV(valueString func([]byte) string) []string {
 	addr := task.Address.String()
 	dv := ""
 	if task.Desired != nil {
-		dv, _ = dp.ParameterValueString(task.Type, task.Desired)
+		dv = valueString(task.Desired)
 	}
 	av := ""
 	if task.Actual != nil {
-		av, _ = dp.ParameterValueString(task.Type, task.Actual)
+		av = valueString(task.Actual)
 	}
 	if task.Disabled {
 		addr = "#" + addr
@@ -122,34 +232,78 @@ func (task *DeviceParameterTask) ToCSV() []string {
 	return []string{addr, task.Parameter, task.Type.String(), dv, av, task.Info}
 }
 
-func (dpd *DeviceParameterDirector) writeTasksToFile(tasks []DeviceParameterTask, filepath string) error {
-	file, err := os.Create(filepath)
-	if err == nil {
-		defer file.Close()
-
-		w := csv.NewWriter(file)
-		defer w.Flush()
+// taskCSV formats the task, using the presentation from the schema if the
+// type of the task matches the schema.
+func (dpd *DeviceParameterDirector) taskCSV(task *DeviceParameterTask) []string {
+	return task.toCSV(func(value []byte) string {
+		return dpd.valueText(task, value)
+	})
+}
 
-		if err := w.Write([]string{"address", "parameter", "type", "desired", "actual", "info"}); err != nil {
-			dpd.Error.Printf("error writing header: %s", err)
-			return err
+// valueText formats a value of the task like it is written to the task file.
+func (dpd *DeviceParameterDirector) valueText(task *DeviceParameterTask, value []byte) string {
+	if dpd.schema != nil {
+		if ps := dpd.schema.Parameter(task.Parameter); ps != nil && ps.Type == task.Type {
+			if s, err := ps.FormatValue(value); err == nil {
+				return s
+			}
 		}
+	}
+	return formatValue(task.Type, value, dpd.format)
+}
 
-		for _, task := range tasks {
-			if err := w.Write(task.ToCSV()); err != nil {
-				dpd.Error.Printf("error writing output: %s", err)
-				return err
-			}
+// parseValue parses a value of the task, using the presentation from the
+// schema if the type of the task matches the schema.
+func (dpd *DeviceParameterDirector) parseValue(task *DeviceParameterTask, text string) ([]byte, error) {
+	if dpd.schema != nil {
+		if ps := dpd.schema.Parameter(task.Parameter); ps != nil && ps.Type == task.Type {
+			return ps.ParseValue(text)
 		}
+	}
+	return dp.ParseParameterValue(task.Type, text)
+}
 
-		return nil
+// taskRecord converts the task to the form in which it is stored.
+func (dpd *DeviceParameterDirector) taskRecord(task *DeviceParameterTask) TaskRecord {
+	record := TaskRecord{Address: task.Address.String(), Parameter: task.Parameter, Type: task.Type.String(),
+		Info: task.Info, Disabled: task.Disabled, Comment: task.Comment, Meta: task.Meta}
+	if task.Desired != nil {
+		record.Desired = dpd.valueText(task, task.Desired)
+	}
+	if task.Actual != nil {
+		record.Actual = dpd.valueText(task, task.Actual)
 	}
-	return err
+	return record
+}
+
+func (dpd *DeviceParameterDirector) writeTasksToFile(tasks []DeviceParameterTask, filepath string) error {
+	return dpd.writeTasks(tasks, LookupTaskStore(filepath), filepath)
+}
+
+// writeTasks writes the tasks to the file in the format of the store, the
+// comment and field order of the task file that was read are preserved.
+func (dpd *DeviceParameterDirector) writeTasks(tasks []DeviceParameterTask, store TaskStore, filepath string) error {
+	list := TaskList{Comment: dpd.list.Comment, MetaFields: dpd.list.MetaFields}
+	list.Tasks = make([]TaskRecord, len(tasks))
+	for i := range tasks {
+		list.Tasks[i] = dpd.taskRecord(&tasks[i])
+	}
+
+	file, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	if err := store.WriteTasks(file, &list); err != nil {
+		file.Close()
+		dpd.Error.Printf("error writing output: %s", err)
+		return err
+	}
+	return file.Close()
 }
 
 func (dpd *DeviceParameterDirector) updateOutput() {
 	newfile := dpd.filepath + ".new"
-	if err := dpd.writeTasksToFile(dpd.tasks, newfile); err == nil {
+	if err := dpd.writeTasks(dpd.tasks, LookupTaskStore(dpd.filepath), newfile); err == nil {
 		err = os.Rename(newfile, dpd.filepath)
 		if err != nil {
 			dpd.Error.Printf("error updating file: %s", err)
@@ -159,210 +313,354 @@ func (dpd *DeviceParameterDirector) updateOutput() {
 	}
 }
 
+// validateTask checks the task against the schema, values that are not going
+// to be set are not checked.
+func (dpd *DeviceParameterDirector) validateTask(task *DeviceParameterTask) error {
+	if task.Type == dp.DP_TYPE_NIL { // Empty value for a variable length parameter
+		return dpd.schema.ValidateValue(task.Parameter, []byte{})
+	}
+	if task.Actual != nil { // Already done, the value is not going to be set
+		return dpd.schema.Validate(task.Parameter, task.Type, nil)
+	}
+	return dpd.schema.Validate(task.Parameter, task.Type, task.Desired)
+}
+
+// blocking reports if a failed task can not succeed by retrying and must be
+// blocked. For other failures the director moves on to the next node and
+// tries again later.
+func blocking(err error) bool {
+	var missing *dp.ParameterError
+	var invalid *dp.InvalidParameterValueError
+	var mismatch *dp.ValueMismatchError
+	var device *dp.DeviceError
+	var schema *dp.SchemaError
+	var typ *dp.TypeMismatchError
+	switch {
+	case errors.As(err, &missing): // No such parameter
+		return true
+	case errors.As(err, &schema), errors.As(err, &typ): // Not going to change by retrying
+		return true
+	case errors.As(err, &invalid): // The type is probably bad
+		return true
+	case errors.As(err, &mismatch): // The mismatch policy has already been applied
+		return true
+	case errors.As(err, &device): // EBUSY and friends may pass, ESIZE and others will not
+		return !device.Temporary()
+	}
+	return false // Timeouts and unexpected failures
+}
+
+// interrupted reports if Stop has been called.
+func (dpd *DeviceParameterDirector) interrupted() bool {
+	select {
+	case <-dpd.interrupt:
+		dpd.Debug.Println("interrupted")
+		return true
+	default:
+	}
+	return false
+}
+
+// cancelled reports if the error was caused by Stop cancelling a request.
+func (dpd *DeviceParameterDirector) cancelled(err error) bool {
+	var ce *dp.ContextError
+	return errors.As(err, &ce) && dpd.ctx.Err() != nil
+}
+
 func (dpd *DeviceParameterDirector) run() {
 	dpd.Debug.Printf("%d tasks in queue\n", len(dpd.tasks))
 
-	interrupted := false
-	for interrupted == false {
-		// organize a queue of nodes
+	client := dp.NewNodeParameterClient(dpd.conn, dpd.group, dpd.address)
+	client.SetLoggers(&dpd.DIWEloggers)
+
+	dpd.started = time.Now()
+	hbs := client.SubscribeHeartbeats() // Overheard heartbeats show that a node is reachable
+	go func() {
+		for hb := range hbs {
+			dpd.expand(hb)
+			dpd.recordHeartbeat(hb)
+		}
+	}()
+
+	for dpd.interrupted() == false {
+		// organize a queue of nodes, responsive nodes first
+		dpd.mutex.Lock()
+		dpd.reexpand() // No workers are running between rounds
 		ns := make(map[moteconnection.AMAddr]bool)
+		pending := make([]moteconnection.AMAddr, 0)
 		for _, task := range dpd.tasks {
-			if task.Disabled == false && task.Blocked == false && task.Actual == nil {
+			if task.pending() && ns[task.Address] == false {
 				ns[task.Address] = true
+				pending = append(pending, task.Address)
 			}
 		}
-		if len(ns) == 0 {
-			break
-		}
-		q := make([]moteconnection.AMAddr, 0, len(ns))
-		for k := range ns {
-			q = append(q, k)
-		}
-
-		dpd.Debug.Printf("%d nodes in queue\n", len(q))
-		// start processing the queue
-		for _, node := range q {
-			dpm := dp.NewDeviceParameterActiveMessageManager(dpd.conn, dpd.group, dpd.address, node)
-			dpm.SetTimeout(dpd.timeout)
-			dpm.SetRetries(int(dpd.retries))
-
-			for idx, task := range dpd.tasks { // look for a suitable task
-				if task.Disabled == false && task.Blocked == false && task.Address == node && task.Actual == nil {
-					dpd.Debug.Printf("%+v\n", task)
-					skip := false
-					if task.Desired == nil && task.Type != dp.DP_TYPE_NIL { // only a read is requested
-						if val, err := dpm.GetValue(task.Parameter); err == nil {
-							task.Type = val.Type
-							task.Actual = val.Value
-							task.Info = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-							dpd.Info.Printf("Got parameter %s from node %s.\n", task.Parameter, task.Address)
-						} else {
-							dpd.Warning.Printf("Failed to get parameter %s from node %s.\n", task.Parameter, task.Address)
-							task.Info = err.Error()
-							switch err.(type) {
-							case dp.ParameterError: // No such parameter?
-								task.Blocked = true
-							case dp.TimeoutError:
-								// just keep trying, but skip to the next node
-								skip = true
-							default:
-								skip = true
-							}
-						}
-					} else { // must set value
-						if val, err := dpm.SetValue(task.Parameter, task.Desired); err == nil {
-							if task.Type != val.Type {
-								dpd.Warning.Printf("Parameter %s set on node %s, but types did not match: %s / %s\n", task.Parameter, task.Address, task.Type, val.Type)
-							}
-							task.Type = val.Type
-							task.Actual = val.Value
-							task.Info = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-							dpd.Info.Printf("Set parameter %s on node %s.\n", task.Parameter, task.Address)
-						} else {
-							dpd.Warning.Printf("Failed to set parameter %s on node %s, result=%s.\n", task.Parameter, task.Address, err.Error())
-							task.Info = err.Error()
-							switch err.(type) {
-							case dp.InvalidParameterValueError: // The type is probably bad
-								task.Blocked = true
-							case dp.ParameterError: // No such parameter?
-								task.Blocked = true
-							case dp.ValueMismatchError:
-								task.Actual = val.Value
-								// not updating the type here just yet
-								task.Blocked = true // blocking it until more advanced handling is added
-							case dp.TimeoutError: // just keep trying, but skip to the next node
-								skip = true
-							default: // Unexpected, possibly EBUSY?
-								skip = true
-							}
-						}
-					}
-
-					dpd.tasks[idx] = task
-					dpd.updateOutput()
-
-					if skip {
-						break // proceed to next node in the queue
-					}
-				}
-
+		q, next := dpd.schedule(pending)
+		dpd.mutex.Unlock()
+		if len(pending) == 0 {
+			if wait := dpd.listening(); wait > 0 { // New nodes may still join the groups
 				select {
 				case <-dpd.interrupt:
-					dpd.Debug.Println("interrupted")
-					interrupted = true
-				default:
-				}
-				if interrupted {
-					break
+				case <-dpd.wakeup:
+				case <-time.After(wait):
 				}
+				continue
 			}
-
-			dpm.Close() // de-initialize the manager, since manager is target specific and moving to next one
-
+			break
+		}
+		if len(q) == 0 { // All remaining nodes are backed off
+			dpd.Debug.Printf("%d nodes backed off until %s\n", len(pending), next.Format("15:04:05"))
 			select {
 			case <-dpd.interrupt:
-				dpd.Debug.Println("interrupted")
-				interrupted = true
-			default:
+			case <-dpd.wakeup:
+			case <-time.After(time.Until(next)):
 			}
-			if interrupted {
+			continue
+		}
+
+		dpd.Debug.Printf("%d nodes in queue\n", len(q))
+		// start processing the queue, nodes are handed out to the workers
+		nodes := make(chan moteconnection.AMAddr)
+		var wg sync.WaitGroup
+		for i := 0; i < dpd.concurrency && i < len(q); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for node := range nodes {
+					dpd.processNode(client, node)
+				}
+			}()
+		}
+		for _, node := range q {
+			if dpd.interrupted() {
 				break
 			}
+			nodes <- node
 		}
+		close(nodes)
+		wg.Wait()
 	}
 
+	client.Close()
 	close(dpd.done)
 }
 
-func (dpd *DeviceParameterDirector) readTaskFile(filepath string) ([]DeviceParameterTask, error) {
-	tasks := make([]DeviceParameterTask, 0)
-
-	csvf, err := os.Open(filepath)
+// processNode works on the tasks of one node in the order they are listed
+// until a task fails temporarily. Every node is handled by a single worker,
+// the task list is shared between the workers and guarded by the mutex.
+func (dpd *DeviceParameterDirector) processNode(client *dp.NodeParameterClient, node moteconnection.AMAddr) {
+	dpm, err := client.Manager(node)
 	if err != nil {
-		return nil, err
+		dpd.Error.Printf("Unable to communicate with node %s: %s\n", node, err)
+		return
 	}
-	defer csvf.Close()
-
-	reader := csv.NewReader(bufio.NewReader(csvf))
-	//reader.LazyQuotes = true
-	reader.TrimLeadingSpace = true
-	reader.FieldsPerRecord = 6
-	//reader.Comment = '#' // Want to preserve comments
-
-	for l := 0; true; l++ {
-		line, err := reader.Read()
-		if err == io.EOF {
-			dpd.Debug.Printf("Read %d lines from %s.\n", l, filepath)
-			break
-		} else if err != nil {
-			dpd.Error.Printf("%s", err)
-			return nil, err
+	defer dpm.Close() // de-initialize the manager, since manager is target specific and moving to next one
+	dpm.SetTimeout(dpd.timeout)
+	dpm.SetRetries(int(dpd.retries))
+	dpm.SetSchema(dpd.schema)
+
+	dpd.mutex.Lock()
+	pending := make([]int, 0)
+	for idx, task := range dpd.tasks { // look for suitable tasks
+		if task.Address == node && task.pending() {
+			pending = append(pending, idx)
 		}
+	}
+	dpd.mutex.Unlock()
 
-		if line[0] == "address" {
-			continue // found the header
-		}
+	for _, idx := range pending {
+		dpd.mutex.Lock()
+		task := dpd.tasks[idx]
+		dpd.mutex.Unlock()
 
-		var task DeviceParameterTask
+		dpd.Debug.Printf("%+v\n", task)
+		skip, err := dpd.processTask(dpm, &task)
 
-		// Tasks/lines in the CSV can be disabled by putting a # in front of them
-		if strings.HasPrefix(line[0], "#") {
-			task.Disabled = true
-			line[0] = line[0][1:len(line[0])]
+		dpd.mutex.Lock()
+		dpd.recordResult(node, err)
+		if !dpd.cancelled(err) { // A stopped task is left as it was
+			dpd.tasks[idx] = task
+			dpd.updateOutput()
 		}
+		dpd.mutex.Unlock()
 
-		// validate node address
-		addr64, err := strconv.ParseUint(line[0], 16, 16)
-		if err != nil {
-			return nil, err
+		if skip || dpd.interrupted() {
+			break // proceed to next node in the queue
 		}
-		addr := moteconnection.AMAddr(addr64)
+	}
+}
 
-		if 0 < addr && addr < 0xFFFF {
-			task.Address = addr
-		} else {
-			return nil, errors.New(fmt.Sprintf("'%s' is not a valid address!", line[0]))
-		}
-		// validate parameter name
-		if 0 < len(line[1]) && len(line[1]) <= 16 {
-			task.Parameter = line[1]
-		} else {
-			return nil, errors.New(fmt.Sprintf("'%s' is not a valid parameter name!", line[1]))
+// processTask executes a single task, skip is returned when the task failed,
+// but may succeed when tried again later.
+func (dpd *DeviceParameterDirector) processTask(dpm *dp.DeviceParameterManager, task *DeviceParameterTask) (skip bool, err error) {
+	var val *dp.DeviceParameter
+	drift := ""
+	if task.Verify {
+		if drift, err = dpd.verifyTask(dpm, task); err != nil {
+			dpd.Warning.Printf("Failed to verify parameter %s on node %s.\n", task.Parameter, task.Address)
+			task.Info = err.Error()
+			if blocking(err) {
+				task.Blocked = true
+			} else { // just keep trying, but skip to the next node
+				skip = true
+			}
+			return skip, err
 		}
-		// validate parameter type
-		task.Type, err = dp.ParseDeviceParameterType(line[2])
-		if err != nil {
-			return nil, err
+		if len(drift) == 0 {
+			return false, nil
 		}
-		// validate parameter desired value
-		if len(line[3]) == 0 {
-			task.Desired = nil
+	}
+
+	if task.Desired == nil && task.Type != dp.DP_TYPE_NIL { // only a read is requested
+		if val, err = dpm.GetValueContext(dpd.ctx, task.Parameter); err == nil {
+			task.Type = val.Type
+			task.Actual = val.Value
+			task.Info = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+			dpd.Info.Printf("Got parameter %s from node %s.\n", task.Parameter, task.Address)
 		} else {
-			task.Desired, err = dp.ParseParameterValue(task.Type, line[3])
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("'%s' is not a valid parameter value!", line[3]))
+			dpd.Warning.Printf("Failed to get parameter %s from node %s.\n", task.Parameter, task.Address)
+			task.Info = err.Error()
+			if blocking(err) {
+				task.Blocked = true
+			} else { // just keep trying, but skip to the next node
+				skip = true
+			}
+		}
+	} else { // must set value
+		note := ""
+		task.setMeta(acceptedField, "") // Only kept if the mismatch policy accepts the value again
+		if val, err = dpm.SetValueContext(dpd.ctx, task.Parameter, task.Desired); err != nil {
+			var mismatch *dp.ValueMismatchError
+			if errors.As(err, &mismatch) {
+				val, note, err = dpd.resolveMismatch(dpm, task, mismatch)
 			}
 		}
-		// validate parameter actual value field
-		if len(line[4]) == 0 {
-			task.Actual = nil
+		if err == nil {
+			if task.Type != val.Type {
+				dpd.Warning.Printf("Parameter %s set on node %s, but types did not match: %s / %s\n", task.Parameter, task.Address, task.Type, val.Type)
+			}
+			task.Type = val.Type
+			task.Actual = val.Value
+			task.Info = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+			if len(drift) > 0 {
+				task.Info += " re-applied, " + drift
+			}
+			if len(note) > 0 {
+				task.Info += " " + note
+			}
+			dpd.Info.Printf("Set parameter %s on node %s.\n", task.Parameter, task.Address)
 		} else {
-			task.Actual, err = dp.ParseParameterValue(task.Type, line[4])
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("'%s' is not a valid parameter value!", line[4]))
+			dpd.Warning.Printf("Failed to set parameter %s on node %s, result=%s.\n", task.Parameter, task.Address, err.Error())
+			task.Info = err.Error()
+			if len(note) > 0 {
+				task.Info += " " + note
+			}
+			if len(drift) > 0 {
+				task.Info += " Re-applying, " + drift
+			}
+			var mismatch *dp.ValueMismatchError
+			if errors.As(err, &mismatch) {
+				task.Actual = mismatch.Actual
+				// not updating the type here just yet
+			}
+			if blocking(err) {
+				task.Blocked = true
+			} else { // just keep trying, but skip to the next node
+				skip = true
 			}
 		}
-		// validate the timestamp?
-		task.Info = line[5]
+	}
+	return skip, err
+}
 
-		// dpd.Debug.Printf("%+v\n", task)
+func (dpd *DeviceParameterDirector) readTaskFile(filepath string) ([]DeviceParameterTask, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list, err := LookupTaskStore(filepath).ReadTasks(bufio.NewReader(f))
+	if err != nil {
+		dpd.Error.Printf("%s", err)
+		return nil, err
+	}
+	dpd.Debug.Printf("Read %d tasks from %s.\n", len(list.Tasks), filepath)
 
+	tasks := make([]DeviceParameterTask, 0, len(list.Tasks))
+	for i := range list.Tasks {
+		task, err := dpd.parseTask(&list.Tasks[i])
+		if err != nil {
+			return nil, err
+		}
 		tasks = append(tasks, task)
 	}
 
+	dpd.list = TaskList{Comment: list.Comment, MetaFields: list.MetaFields}
 	return tasks, nil
 }
 
+// parseTask validates a task that was read from a task file.
+func (dpd *DeviceParameterDirector) parseTask(record *TaskRecord) (DeviceParameterTask, error) {
+	var task DeviceParameterTask
+	var err error
+
+	task.Disabled = record.Disabled
+	task.Comment = record.Comment
+	task.Meta = record.Meta
+
+	// validate node address
+	addr64, err := strconv.ParseUint(record.Address, 16, 16)
+	if err != nil {
+		return task, err
+	}
+	addr := moteconnection.AMAddr(addr64)
+
+	if 0 < addr && addr < 0xFFFF {
+		task.Address = addr
+	} else {
+		return task, errors.New(fmt.Sprintf("'%s' is not a valid address!", record.Address))
+	}
+	// validate parameter name
+	if 0 < len(record.Parameter) && len(record.Parameter) <= 16 {
+		task.Parameter = record.Parameter
+	} else {
+		return task, errors.New(fmt.Sprintf("'%s' is not a valid parameter name!", record.Parameter))
+	}
+	// validate parameter type
+	task.Type, err = dp.ParseDeviceParameterType(record.Type)
+	if err != nil {
+		return task, err
+	}
+	// validate parameter desired value
+	if len(record.Desired) > 0 {
+		task.Desired, err = dpd.parseValue(&task, record.Desired)
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("'%s' is not a valid parameter value!", record.Desired))
+		}
+	}
+	// validate parameter actual value field
+	if strings.HasPrefix(record.Actual, rawPrefix) {
+		task.Actual, err = hex.DecodeString(strings.TrimPrefix(record.Actual, rawPrefix))
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("'%s' is not a valid parameter value!", record.Actual))
+		}
+	} else if len(record.Actual) > 0 {
+		task.Actual, err = dpd.parseValue(&task, record.Actual)
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("'%s' is not a valid parameter value!", record.Actual))
+		}
+	}
+	// validate the timestamp?
+	task.Info = record.Info
+
+	if dpd.schema != nil && !task.Disabled {
+		if err := dpd.validateTask(&task); err != nil {
+			return task, errors.New(fmt.Sprintf("Task %s %s: %s", task.Address, task.Parameter, err))
+		}
+	}
+	return task, nil
+}
+
 func (dpd *DeviceParameterDirector) readNodeFile(filepath string) ([]moteconnection.AMAddr, error) {
 	nf, err := os.Open(filepath)
 	if err != nil {
@@ -394,11 +692,9 @@ func (dpd *DeviceParameterDirector) Start(filepath string) error {
 	if err != nil {
 		return err
 	}
+	dpd.markVerify(tasks)
 	dpd.tasks = tasks
 
-	// setup sniffing dispatchers
-	// generate statistics for choosing next target?
-
 	// start statemachine
 	dpd.done = make(chan bool)
 	go dpd.run()
@@ -410,27 +706,35 @@ func (dpd *DeviceParameterDirector) StartWithTemplate(filepath string, template
 	if _, err := os.Stat(filepath); err == nil {
 		dpd.Info.Printf("Task file exists, not using template.")
 	} else {
-		templateTasks, err := dpd.readTaskFile(template)
+		tasks, err := dpd.templateTasks(template, nodelist)
 		if err != nil {
 			return err
 		}
+		dpd.writeTasksToFile(tasks, filepath)
+	}
+	return dpd.Start(filepath)
+}
 
-		nodes, err := dpd.readNodeFile(nodelist)
-		if err != nil {
-			return err
-		}
+// templateTasks applies the template to every node in the node list.
+func (dpd *DeviceParameterDirector) templateTasks(template string, nodelist string) ([]DeviceParameterTask, error) {
+	templateTasks, err := dpd.readTaskFile(template)
+	if err != nil {
+		return nil, err
+	}
 
-		tasks := make([]DeviceParameterTask, 0, len(nodes)*len(templateTasks))
-		for _, node := range nodes {
-			for _, task := range templateTasks {
-				task.Address = node
-				tasks = append(tasks, task)
-			}
-		}
+	nodes, err := dpd.readNodeFile(nodelist)
+	if err != nil {
+		return nil, err
+	}
 
-		dpd.writeTasksToFile(tasks, filepath)
+	tasks := make([]DeviceParameterTask, 0, len(nodes)*len(templateTasks))
+	for _, node := range nodes {
+		for _, task := range templateTasks {
+			task.Address = node
+			tasks = append(tasks, task)
+		}
 	}
-	return dpd.Start(filepath)
+	return tasks, nil
 }
 
 func (dpd *DeviceParameterDirector) Finished() bool {
@@ -444,6 +748,7 @@ func (dpd *DeviceParameterDirector) Finished() bool {
 
 func (dpd *DeviceParameterDirector) Stop() {
 	close(dpd.interrupt) // interrupt the statemachine
+	dpd.cancel()         // and the requests in progress
 	<-dpd.done           // wait for it to finish
 	// deinitialize the dispatchers
 }
@@ -0,0 +1,877 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proactivity-lab/go-moteconnection"
+
+	dp "github.com/thinnect/go-devparam"
+	"github.com/thinnect/go-devparam/devsim"
+)
+
+func runDirector(t *testing.T, conn moteconnection.MoteConnection, tasks string, opts ...option) []DeviceParameterTask {
+	path := filepath.Join(t.TempDir(), "tasks.csv")
+	if err := os.WriteFile(path, []byte("address,parameter,type,desired,actual,info\n"+tasks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return runDirectorFile(t, conn, path, opts...)
+}
+
+func runDirectorFile(t *testing.T, conn moteconnection.MoteConnection, path string, opts ...option) []DeviceParameterTask {
+	dpd, err := NewDeviceParameterDirector(conn, 0x22, 0x5678, append([]option{Timeout(50 * time.Millisecond), Retries(0), Backoff(10*time.Millisecond, 100*time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dpd.Start(path); err != nil {
+		t.Fatal(err)
+	}
+	return waitDirector(t, dpd, path)
+}
+
+// waitDirector waits for the director to finish and returns the stored tasks.
+func waitDirector(t *testing.T, dpd *DeviceParameterDirector, path string) []DeviceParameterTask {
+	deadline := time.Now().Add(5 * time.Second)
+	for !dpd.Finished() {
+		if time.Now().After(deadline) {
+			dpd.Stop()
+			t.Fatalf("director did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stored, err := dpd.readTaskFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(dpd.tasks) {
+		t.Fatalf("%d tasks stored, %d expected", len(stored), len(dpd.tasks))
+	}
+	for i := range stored {
+		stored[i].Blocked = dpd.tasks[i].Blocked // Not persisted
+	}
+	return stored
+}
+
+func TestDirectorFailureClasses(t *testing.T) {
+	u8 := devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{11}}
+	clamped := u8
+	clamped.Clamp = func(value []byte) []byte { return []byte{20} }
+
+	tests := []struct {
+		name    string
+		param   *devsim.Parameter
+		inject  []dp.DeviceErrorCode
+		offline time.Duration
+		task    string
+		actual  []byte
+		blocked bool
+		info    string
+	}{
+		{"get", &devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT32, Value: []byte{0, 0, 4, 0xD2}}, nil, 0, "0001,p,u32,,,", []byte{0, 0, 4, 0xD2}, false, ""},
+		{"set", &u8, nil, 0, "0001,p,u8,15,,", []byte{15}, false, ""},
+		{"missing get", nil, nil, 0, "0001,p,u8,,,", nil, true, "No parameter"},
+		{"missing set", nil, nil, 0, "0001,p,u8,15,,", nil, true, "No parameter"},
+		{"einval", &u8, []dp.DeviceErrorCode{dp.ErrInvalid}, 0, "0001,p,u8,15,,", nil, true, "EINVAL"},
+		{"esize", &u8, []dp.DeviceErrorCode{dp.ErrSize}, 0, "0001,p,u8,15,,", nil, true, "ESIZE"},
+		{"ebusy", &u8, []dp.DeviceErrorCode{dp.ErrBusy, dp.ErrBusy}, 0, "0001,p,u8,15,,", []byte{15}, false, ""},
+		{"mismatch", &clamped, nil, 0, "0001,p,u8,25,,", []byte{20}, true, "does not match"},
+		{"timeout", &u8, nil, 200 * time.Millisecond, "0001,p,u8,15,,", []byte{15}, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var node *devsim.Node
+			if test.param != nil {
+				node = devsim.NewNode(0x0001, 1, *test.param)
+			} else {
+				node = devsim.NewNode(0x0001, 1)
+			}
+			node.InjectError("p", test.inject...)
+			if test.offline > 0 {
+				node.SetFaults(devsim.Faults{Offline: true})
+				time.AfterFunc(test.offline, func() { node.SetFaults(devsim.Faults{}) })
+			}
+
+			net := devsim.NewNetwork()
+			net.AddNode(node)
+			defer net.Close()
+			conn, err := net.NewConnection(0x22)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Disconnect()
+
+			tasks := runDirector(t, conn, test.task+"\n")
+			task := tasks[0]
+			if !bytes.Equal(task.Actual, test.actual) {
+				t.Errorf("actual %X, expected %X", task.Actual, test.actual)
+			}
+			if task.Blocked != test.blocked {
+				t.Errorf("blocked %t, expected %t", task.Blocked, test.blocked)
+			}
+			if !strings.Contains(task.Info, test.info) {
+				t.Errorf("info \"%s\" does not contain \"%s\"", task.Info, test.info)
+			}
+		})
+	}
+}
+
+func TestMismatchPolicy(t *testing.T) {
+	schema := &dp.Schema{Parameters: []*dp.ParameterSchema{
+		{Name: "p", Type: dp.DP_TYPE_UINT8, Allowed: []string{"20", "25"}},
+		{Name: "q", Type: dp.DP_TYPE_UINT8, Allowed: []string{"25", "30"}},
+	}}
+	if err := schema.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		param   string
+		policy  MismatchPolicy
+		clamp   func(node *devsim.Node, calls int, value []byte) []byte
+		actual  byte
+		blocked bool
+		info    string
+	}{
+		{"fail", "p", MismatchPolicy{}, nil, 20, true, "blocked: desired 25, actual 20"},
+		{"reread", "p", MismatchPolicy{Reread: true}, func(node *devsim.Node, calls int, value []byte) []byte {
+			time.AfterFunc(5*time.Millisecond, func() { node.SetValue("p", value) }) // Applied late, the response is stale
+			return []byte{20}
+		}, 25, false, "confirmed by re-read: desired 25, actual 25"},
+		{"retry", "p", MismatchPolicy{Retries: 2}, func(node *devsim.Node, calls int, value []byte) []byte {
+			if calls < 2 {
+				return []byte{20}
+			}
+			return value
+		}, 25, false, "set on retry 1"},
+		{"retries exhausted", "p", MismatchPolicy{Reread: true, Retries: 2}, nil, 20, true, "re-read, retried 2 times, blocked: desired 25, actual 20"},
+		{"accept", "p", MismatchPolicy{Accept: true}, nil, 20, false, "accepted as valid in schema: desired 25, actual 20"},
+		{"not acceptable", "q", MismatchPolicy{Accept: true}, nil, 20, true, "not valid in schema, blocked"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var node *devsim.Node
+			calls := 0
+			clamp := func(value []byte) []byte {
+				calls++
+				if test.clamp != nil {
+					return test.clamp(node, calls, value)
+				}
+				return []byte{20}
+			}
+			node = devsim.NewNode(0x0001, 1, devsim.Parameter{Name: test.param, Type: dp.DP_TYPE_UINT8, Value: []byte{11}, Clamp: clamp})
+			node.SetFaults(devsim.Faults{Delay: 20 * time.Millisecond})
+
+			net := devsim.NewNetwork()
+			net.AddNode(node)
+			defer net.Close()
+			conn, err := net.NewConnection(0x22)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Disconnect()
+
+			task := runDirector(t, conn, "0001,"+test.param+",u8,25,,\n", Timeout(time.Second), Schema(schema), Mismatch(test.policy))[0]
+			if !bytes.Equal(task.Actual, []byte{test.actual}) {
+				t.Errorf("actual %X, expected %X", task.Actual, test.actual)
+			}
+			if task.Blocked != test.blocked {
+				t.Errorf("blocked %t, expected %t", task.Blocked, test.blocked)
+			}
+			if !strings.Contains(task.Info, test.info) {
+				t.Errorf("info \"%s\" does not contain \"%s\"", task.Info, test.info)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	node := devsim.NewNode(0x0001, 1,
+		devsim.Parameter{Name: "a", Type: dp.DP_TYPE_UINT8, Value: []byte{10}},
+		devsim.Parameter{Name: "b", Type: dp.DP_TYPE_UINT8, Value: []byte{11}}, // Drifted, 20 was set earlier
+		devsim.Parameter{Name: "c", Type: dp.DP_TYPE_UINT32, Value: []byte{0, 0, 0, 5}})
+	net := devsim.NewNetwork()
+	net.AddNode(node)
+	defer net.Close()
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	tasks := "0001,a,u8,10,10,2019-01-01T12:00:00Z\n0001,b,u8,20,20,2019-01-01T12:00:00Z\n0001,c,u32,,4,2019-01-01T12:00:00Z\n#0001,b,u8,30,30,\n"
+	runDirector(t, conn, tasks)
+	if n := node.Requests(); n != 0 {
+		t.Errorf("%d requests for completed tasks", n)
+	}
+
+	stored := runDirector(t, conn, tasks, Verify(true))
+	expected := []struct {
+		actual []byte
+		info   string
+	}{
+		{[]byte{10}, "verified"},
+		{[]byte{20}, "re-applied, drifted from 20 to 11"},
+		{[]byte{0, 0, 0, 5}, "verified"},
+		{[]byte{30}, ""},
+	}
+	for i, e := range expected {
+		if !bytes.Equal(stored[i].Actual, e.actual) || !strings.Contains(stored[i].Info, e.info) || stored[i].Blocked {
+			t.Errorf("task %d: unexpected result %+v", i, stored[i])
+		}
+	}
+	if v, _ := node.Value("b"); !bytes.Equal(v, []byte{20}) {
+		t.Errorf("drifted value not re-applied, %X", v)
+	}
+	if n := node.Requests(); n != 4 {
+		t.Errorf("%d requests instead of 4", n)
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	schema := &dp.Schema{Parameters: []*dp.ParameterSchema{
+		{Name: "p", Type: dp.DP_TYPE_UINT8, Allowed: []string{"20", "25"}},
+		{Name: "q", Type: dp.DP_TYPE_UINT8, Allowed: []string{"25", "30"}},
+	}}
+	if err := schema.Init(); err != nil {
+		t.Fatal(err)
+	}
+	clamp := func(value []byte) []byte { return []byte{20} }
+	node := devsim.NewNode(0x0001, 1,
+		devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{11}, Clamp: clamp},
+		devsim.Parameter{Name: "q", Type: dp.DP_TYPE_UINT8, Value: []byte{11}, Clamp: clamp})
+	net := devsim.NewNetwork()
+	net.AddNode(node)
+	defer net.Close()
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	path := filepath.Join(t.TempDir(), "tasks.csv")
+	if err := os.WriteFile(path, []byte("address,parameter,type,desired,actual,info\n0001,p,u8,25,,\n0001,q,u8,25,,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := []option{Schema(schema), Mismatch(MismatchPolicy{Accept: true})}
+	stored := runDirectorFile(t, conn, path, opts...)
+	if stored[0].Meta[acceptedField] != "20" || stored[0].Blocked || stored[1].Meta[acceptedField] != "" || !stored[1].Blocked {
+		t.Fatalf("unexpected tasks %+v", stored)
+	}
+	requests := node.Requests()
+
+	// The accepted value is verified, the blocked one is set again
+	stored = runDirectorFile(t, conn, path, append(opts, Verify(true))...)
+	if !strings.Contains(stored[0].Info, "verified") || stored[0].Meta[acceptedField] != "20" {
+		t.Errorf("accepted value not verified %+v", stored[0])
+	}
+	if !strings.Contains(stored[1].Info, "drifted from 25 to 20") || !stored[1].Blocked {
+		t.Errorf("blocked value not set again %+v", stored[1])
+	}
+	if n := node.Requests() - requests; n != 3 {
+		t.Errorf("%d requests instead of 3", n)
+	}
+}
+
+func TestDirectorConcurrency(t *testing.T) {
+	net := devsim.NewNetwork()
+	defer net.Close()
+	tasks := ""
+	for addr := moteconnection.AMAddr(1); addr <= 8; addr++ {
+		node := devsim.NewNode(addr, uint64(addr),
+			devsim.Parameter{Name: "a", Type: dp.DP_TYPE_UINT8, Value: []byte{1}},
+			devsim.Parameter{Name: "b", Type: dp.DP_TYPE_UINT8, Value: []byte{2}})
+		node.SetFaults(devsim.Faults{Delay: 30 * time.Millisecond})
+		net.AddNode(node)
+		tasks += fmt.Sprintf("%s,a,u8,10,,\n%s,b,u8,,,\n", addr, addr)
+	}
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	start := time.Now()
+	stored := runDirector(t, conn, tasks, Timeout(time.Second), Concurrency(8))
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond { // Sequentially at least 16 * 30ms
+		t.Errorf("nodes were not processed in parallel, took %s", elapsed)
+	}
+	for i, task := range stored {
+		if task.Actual == nil || task.Blocked {
+			t.Errorf("task %d not completed %+v", i, task)
+		}
+		if v, _ := net.Node(task.Address).Value("a"); !bytes.Equal(v, []byte{10}) {
+			t.Errorf("node %s value %X", task.Address, v)
+		}
+	}
+
+	if _, err := NewDeviceParameterDirector(conn, 0x22, 0x5678, Concurrency(0)); err == nil {
+		t.Errorf("concurrency 0 accepted")
+	}
+}
+
+func TestDirectorStop(t *testing.T) {
+	net := devsim.NewNetwork()
+	defer net.Close()
+	offline := devsim.NewNode(0x0001, 1, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{1}})
+	offline.SetFaults(devsim.Faults{Offline: true})
+	net.AddNode(offline)
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	path := filepath.Join(t.TempDir(), "tasks.csv")
+	if err := os.WriteFile(path, []byte("address,parameter,type,desired,actual,info\n0001,p,u8,5,,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dpd, err := NewDeviceParameterDirector(conn, 0x22, 0x5678, Timeout(10*time.Second), Retries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dpd.Start(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // The set is in progress
+	start := time.Now()
+	dpd.Stop()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Stop took %s", d)
+	}
+	if dpd.tasks[0].Actual != nil || len(dpd.tasks[0].Info) > 0 {
+		t.Errorf("stopped task was changed %+v", dpd.tasks[0])
+	}
+}
+
+func TestDirectorStatistics(t *testing.T) {
+	net := devsim.NewNetwork()
+	defer net.Close()
+	offline := devsim.NewNode(0x0001, 1, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{1}})
+	offline.SetFaults(devsim.Faults{Offline: true})
+	net.AddNode(offline)
+	net.AddNode(devsim.NewNode(0x0002, 2, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{2}}))
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	time.AfterFunc(300*time.Millisecond, func() {
+		offline.SetFaults(devsim.Faults{})
+		net.Heartbeat(0x0001) // Must end the backoff early
+	})
+	start := time.Now()
+	runDirector(t, conn, "0001,p,u8,,,\n0002,p,u8,,,\n", Backoff(10*time.Second, 10*time.Second))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("heartbeat did not end the backoff, took %s", elapsed)
+	}
+
+	// The scheduler is checked directly with prepared statistics
+	dpd, _ := NewDeviceParameterDirector(nil, 0x22, 0x5678, Backoff(time.Second, 4*time.Second))
+	dpd.mutex.Lock()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		dpd.recordResult(0x0001, dp.NewTimeoutError("timeout"))
+	}
+	if st := dpd.stats[0x0001]; st.Timeouts != 3 || st.ConsecutiveTimeouts != 3 || st.NextAttempt.Sub(now) < 4*time.Second {
+		t.Errorf("unexpected statistics %+v", st)
+	}
+	dpd.recordResult(0x0002, nil)
+	dpd.recordResult(0x0003, dp.NewTimeoutError("timeout"))
+	dpd.stats[0x0003].NextAttempt = time.Time{} // Backoff has passed
+	dpd.recordResult(0x0004, nil)
+	dpd.stats[0x0004].LastSeen = now.Add(time.Second)
+	ready, next := dpd.schedule([]moteconnection.AMAddr{0x0001, 0x0002, 0x0003, 0x0004, 0x0005})
+	dpd.mutex.Unlock()
+
+	if fmt.Sprint(ready) != "[0004 0002 0005 0003]" || next != dpd.stats[0x0001].NextAttempt {
+		t.Errorf("unexpected schedule %v %s", ready, next)
+	}
+
+	dpd.recordHeartbeat(&dp.DeviceHeartbeat{Address: 0x0001, Timestamp: now})
+	stats := dpd.Statistics()
+	if len(stats) != 5 || stats[0].Address != 0x0001 || stats[0].Heartbeats != 1 || stats[0].ConsecutiveTimeouts != 0 || !stats[0].NextAttempt.IsZero() {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestTaskFormat(t *testing.T) {
+	task := DeviceParameterTask{Address: 0x0001, Parameter: "mask", Type: dp.DP_TYPE_UINT16, Desired: []byte{0x1F, 0x40}, Actual: []byte{0x00, 0x0A}}
+	if line := strings.Join(task.ToCSV(), ","); line != "0001,mask,u16,8000,10," {
+		t.Errorf("unexpected line %s", line)
+	}
+	if line := strings.Join(task.ToCSVFormat(dp.FormatHex), ","); line != "0001,mask,u16,0x1F40,0x000A," {
+		t.Errorf("unexpected line %s", line)
+	}
+
+	path := filepath.Join(t.TempDir(), "tasks.csv")
+	if err := os.WriteFile(path, []byte("address,parameter,type,desired,actual,info\n0001,mask,u16,0x1F40,0b1010,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dpd, _ := NewDeviceParameterDirector(nil, 0x22, 0x5678)
+	tasks, err := dpd.readTaskFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tasks[0].Desired, task.Desired) || !bytes.Equal(tasks[0].Actual, task.Actual) {
+		t.Errorf("unexpected task %+v", tasks[0])
+	}
+
+	// A value of the wrong length is kept in hex
+	task.Actual = []byte{0x0A}
+	if line := strings.Join(task.ToCSV(), ","); line != "0001,mask,u16,8000,raw:0A," {
+		t.Errorf("unexpected line %s", line)
+	}
+	if err := dpd.writeTasksToFile([]DeviceParameterTask{task}, path); err != nil {
+		t.Fatal(err)
+	}
+	if tasks, err = dpd.readTaskFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tasks[0].Actual, task.Actual) {
+		t.Errorf("unexpected task %+v", tasks[0])
+	}
+}
+
+func TestTaskSchema(t *testing.T) {
+	schema := &dp.Schema{Parameters: []*dp.ParameterSchema{
+		{Name: "temperature", Type: dp.DP_TYPE_INT16, Presentation: "scaled:0.1"},
+		{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Max: new(float64)},
+		{Name: "mode", Type: dp.DP_TYPE_UINT8, Enum: map[string]int64{"router": 1, "sleepy_router": 3}},
+		{Name: "features", Type: dp.DP_TYPE_UINT16, Flags: map[string]uint{"led": 0, "beacon": 1}},
+	}}
+	*schema.Parameters[1].Max = 26
+	if err := schema.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		task    string
+		desired []byte
+		valid   bool
+	}{
+		{"0001,temperature,i16,-4.5,,", []byte{0xFF, 0xD3}, true},
+		{"0001,radio_channel,u8,26,,", []byte{26}, true},
+		{"0001,radio_channel,u8,27,,", nil, false},
+		{"0001,radio_channel,u16,20,,", nil, false},
+		{"0001,mode,u8,sleepy_router,router,", []byte{3}, true},
+		{"0001,features,u16,led|beacon,,", []byte{0, 3}, true},
+		{"0001,mode,u8,2,,", nil, false},
+		{"0001,features,u16,led|sound,,", nil, false},
+		{"0001,missing,u8,1,,", nil, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "tasks.csv")
+		if err := os.WriteFile(path, []byte("address,parameter,type,desired,actual,info\n"+test.task+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dpd, _ := NewDeviceParameterDirector(nil, 0x22, 0x5678, Schema(schema))
+		tasks, err := dpd.readTaskFile(path)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: accepted", test.task)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.task, err)
+		} else if !bytes.Equal(tasks[0].Desired, test.desired) {
+			t.Errorf("%s: desired %X", test.task, tasks[0].Desired)
+		} else if line := strings.Join(dpd.taskCSV(&tasks[0]), ","); line != test.task {
+			t.Errorf("%s: written as %s", test.task, line)
+		}
+	}
+}
+
+func TestTaskStores(t *testing.T) {
+	files := map[string]string{
+		"tasks.csv": `address,parameter,type,desired,actual,info,owner
+## first node
+0001,p,u8,15,,,alice
+#0002,q,str,"a, b",,,
+## end of file
+`,
+		"tasks.json": `{
+  "comment": "end of file",
+  "nodes": [
+    {"address": "0001", "tasks": [{"parameter": "p", "type": "u8", "desired": 15, "comment": "first node", "meta": {"owner": "alice"}}]},
+    {"address": "0002", "tasks": [{"parameter": "q", "type": "str", "desired": "a, b", "disabled": true}]}
+  ]
+}
+`,
+		"tasks.yaml": `comment: end of file
+nodes:
+  - address: 0001
+    tasks:
+      - parameter: p
+        type: u8
+        desired: 15
+        comment: first node
+        meta: {owner: alice}
+  - address: 0002
+    tasks:
+      - {parameter: q, type: str, desired: "a, b", disabled: true}
+`,
+	}
+
+	check := func(name string, dpd *DeviceParameterDirector, tasks []DeviceParameterTask) {
+		if len(tasks) != 2 {
+			t.Fatalf("%s: %d tasks", name, len(tasks))
+		}
+		if tasks[0].Address != 0x0001 || !bytes.Equal(tasks[0].Desired, []byte{15}) || tasks[0].Comment != "first node" || tasks[0].Meta["owner"] != "alice" || tasks[0].Disabled {
+			t.Errorf("%s: unexpected task %+v", name, tasks[0])
+		}
+		if tasks[1].Address != 0x0002 || string(tasks[1].Desired) != "a, b" || !tasks[1].Disabled {
+			t.Errorf("%s: unexpected task %+v", name, tasks[1])
+		}
+		if dpd.list.Comment != "end of file" {
+			t.Errorf("%s: comment \"%s\"", name, dpd.list.Comment)
+		}
+	}
+
+	for name, content := range files {
+		dir := t.TempDir()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dpd, _ := NewDeviceParameterDirector(nil, 0x22, 0x5678)
+		tasks, err := dpd.readTaskFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		check(name, dpd, tasks)
+
+		other := filepath.Join(dir, "copy"+filepath.Ext(name))
+		if err := dpd.writeTasksToFile(tasks, other); err != nil {
+			t.Fatal(err)
+		}
+		dpd, _ = NewDeviceParameterDirector(nil, 0x22, 0x5678)
+		tasks, err = dpd.readTaskFile(other)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		check(name+" copy", dpd, tasks)
+	}
+
+	// The file is updated in its own format
+	path := filepath.Join(t.TempDir(), "tasks.yaml")
+	if err := os.WriteFile(path, []byte(files["tasks.yaml"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	net := devsim.NewNetwork()
+	net.AddNode(devsim.NewNode(0x0001, 1, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{0}}))
+	defer net.Close()
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	tasks := runDirectorFile(t, conn, path)
+	if !bytes.Equal(tasks[0].Actual, []byte{15}) || tasks[0].Comment != "first node" || tasks[0].Meta["owner"] != "alice" {
+		t.Errorf("unexpected task %+v", tasks[0])
+	}
+	if tasks[1].Actual != nil {
+		t.Errorf("disabled task was processed")
+	}
+
+	for _, invalid := range []string{"address,parameter,type\n", "address,parameter,type,desired,actual,info\n0001,p,u8,15,\n"} {
+		if _, err := (CSVTaskStore{}).ReadTasks(strings.NewReader(invalid)); err == nil {
+			t.Errorf("accepted %q", invalid)
+		}
+	}
+	commented := "## tasks\naddress,parameter,type,desired,actual,info\n## first\n## node\n0001,p,u8,15,\n"
+	if _, err := (CSVTaskStore{}).ReadTasks(strings.NewReader(commented)); err == nil || !strings.HasPrefix(err.Error(), "Line 5:") {
+		t.Errorf("wrong line reported: %v", err)
+	}
+	commented = "## tasks\naddress,parameter,type,desired,actual,info\n## first\n0001,p,u8,\"15,,\n"
+	if _, err := (CSVTaskStore{}).ReadTasks(strings.NewReader(commented)); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("wrong line reported: %v", err)
+	}
+	if _, err := (YAMLTaskStore{}).ReadTasks(strings.NewReader("nodes:\n  - address: 0001\n    task: []\n")); err == nil {
+		t.Errorf("unknown field accepted")
+	}
+}
+
+const desiredState = `
+groups:
+  - name: base
+    parameters:
+      - {name: radio_channel, type: u8, value: 11}
+      - {name: name, type: str}
+  - name: routers
+    inherit: [base]
+    ranges: [0001-000F]
+    parameters:
+      - {name: mode, type: u8, value: 1}
+  - name: vendor
+    eui64: 70b3d5*
+    parameters:
+      - {name: radio_channel, type: u8, value: 20}
+  - name: sensors
+    inherit: [base]
+    nodes: ["0100"]
+    tags: [sensor]
+    parameters:
+      - {name: interval, type: u16, value: 0x3C}
+nodes:
+  - address: 0002
+    eui64: 70B3D50000000002
+    parameters:
+      - {name: mode, type: u8, value: 3}
+  - address: 0200
+    tags: [sensor]
+    parameters:
+      - {name: radio_channel, value: 15}
+`
+
+func TestDesiredState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.yaml")
+	if err := os.WriteFile(path, []byte(desiredState), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := ReadDesiredState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := state.Known()
+	if len(known) != 3 || known[0].Address != 0x0002 || known[1].Address != 0x0100 || known[2].Address != 0x0200 {
+		t.Errorf("unexpected known nodes %+v", known)
+	}
+
+	tests := []struct {
+		node   NodeInfo
+		groups string
+		tasks  string
+	}{
+		{NodeInfo{Address: 0x0001}, "routers", "radio_channel=11/base name=/base mode=1/routers"},
+		{NodeInfo{Address: 0x0002}, "routers vendor", "radio_channel=20/vendor name=/base mode=3/node"},
+		{NodeInfo{Address: 0x0003, Eui64: 0x70B3D50000000003}, "routers vendor", "radio_channel=20/vendor name=/base mode=1/routers"},
+		{NodeInfo{Address: 0x0100}, "sensors", "radio_channel=11/base name=/base interval=0x3C/sensors"},
+		{NodeInfo{Address: 0x0200}, "sensors", "radio_channel=15/node name=/base interval=0x3C/sensors"},
+		{NodeInfo{Address: 0x0300, Tags: []string{"sensor"}}, "sensors", "radio_channel=11/base name=/base interval=0x3C/sensors"},
+		{NodeInfo{Address: 0x0300}, "", ""},
+	}
+	for _, test := range tests {
+		if groups := strings.Join(state.Membership(test.node), " "); groups != test.groups {
+			t.Errorf("%s: groups \"%s\", expected \"%s\"", test.node.Address, groups, test.groups)
+		}
+		tasks := make([]string, 0)
+		for _, r := range state.Compile(test.node) {
+			if r.Address != test.node.Address.String() {
+				t.Errorf("%s: task for %s", test.node.Address, r.Address)
+			}
+			tasks = append(tasks, fmt.Sprintf("%s=%s/%s", r.Parameter, r.Desired, r.Meta["group"]))
+		}
+		if s := strings.Join(tasks, " "); s != test.tasks {
+			t.Errorf("%s: tasks \"%s\", expected \"%s\"", test.node.Address, s, test.tasks)
+		}
+	}
+
+	// The override of node 0200 only gives the value, the type is inherited
+	dpd, _ := NewDeviceParameterDirector(nil, 0x22, 0x5678)
+	dpd.desired = state
+	if tasks, err := dpd.compileTasks(NodeInfo{Address: 0x0200}); err != nil {
+		t.Errorf("compile: %s", err)
+	} else if tasks[0].Type != dp.DP_TYPE_UINT8 || !bytes.Equal(tasks[0].Desired, []byte{15}) {
+		t.Errorf("unexpected task %+v", tasks[0])
+	}
+
+	for _, invalid := range []string{
+		"groups: [{name: a, inherit: [b]}, {name: b, inherit: [a]}]",
+		"groups: [{name: a, inherit: [c]}]",
+		"groups: [{name: a}, {name: a}]",
+		"groups: [{name: a, ranges: [0010-0001]}]",
+		"groups: [{name: a, ranges: [0001]}]",
+		"groups: [{name: a, eui64: \"[\"}]",
+		"groups: [{name: a, parameters: [{name: p, type: u9}]}]",
+		"groups: [{name: a, parameters: [{name: p}, {name: p}]}]",
+		"nodes: [{address: 0001}, {address: 0001}]",
+		"nodes: [{address: FFFF}]",
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadDesiredState(path); err == nil {
+			t.Errorf("accepted %s", invalid)
+		}
+	}
+}
+
+func TestDirectorDesiredState(t *testing.T) {
+	state := &DesiredState{
+		Groups: []*NodeGroup{
+			{Name: "all", Ranges: []string{"0001-00FF"}, Parameters: []DesiredParameter{{Name: "p", Type: "u8", Value: "5"}}},
+			{Name: "special", Eui64: "AB*", Parameters: []DesiredParameter{{Name: "q", Value: "7"}}},
+			{Name: "replaced", Eui64: "CD*", Parameters: []DesiredParameter{{Name: "p", Value: "9"}}},
+		},
+	}
+	if err := state.Init(); err != nil {
+		t.Fatal(err)
+	}
+	schema := &dp.Schema{Parameters: []*dp.ParameterSchema{{Name: "p", Type: dp.DP_TYPE_UINT8}, {Name: "q", Type: dp.DP_TYPE_UINT8}}}
+	if err := schema.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	list := filepath.Join(dir, "nodes.txt")
+	if err := os.WriteFile(list, []byte("0001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tasks.csv")
+
+	net := devsim.NewNetwork()
+	for _, node := range []*devsim.Node{
+		devsim.NewNode(0x0001, 0x0001, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{0}}),
+		devsim.NewNode(0x0002, 0xAB00000000000002, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{0}},
+			devsim.Parameter{Name: "q", Type: dp.DP_TYPE_UINT8, Value: []byte{0}}),
+	} {
+		net.AddNode(node)
+	}
+	defer net.Close()
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	start := func() *DeviceParameterDirector {
+		dpd, err := NewDeviceParameterDirector(conn, 0x22, 0x5678, Timeout(50*time.Millisecond), Retries(0),
+			Backoff(10*time.Millisecond, 100*time.Millisecond), Schema(schema), Listen(300*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dpd.StartWithDesiredState(path, state, list); err != nil {
+			t.Fatal(err)
+		}
+		return dpd
+	}
+
+	// Node 0002 is not listed, it joins both groups when it is heard from
+	dpd := start()
+	time.AfterFunc(100*time.Millisecond, func() { net.Heartbeat(0x0002) })
+	tasks := waitDirector(t, dpd, path)
+	if len(tasks) != 3 {
+		t.Fatalf("%d tasks, expected 3", len(tasks))
+	}
+	for i, expected := range []string{"0001,p,u8,5,5", "0002,p,u8,5,5", "0002,q,u8,7,7"} {
+		if line := strings.Join(dpd.taskCSV(&tasks[i])[:5], ","); line != expected {
+			t.Errorf("task %s, expected %s", line, expected)
+		}
+	}
+	if tasks[2].Meta["group"] != "special" || tasks[2].Meta["eui64"] != "AB00000000000002" {
+		t.Errorf("unexpected meta %v", tasks[2].Meta)
+	}
+
+	// Completed tasks are kept, changed values are compiled again and the
+	// EUI-64 of node 0002 is known from the task file
+	net.Node(0x0001).SetValue("p", []byte{1})
+	state.Groups[1].Parameters[0].Value = "8"
+	tasks = waitDirector(t, start(), path)
+	if len(tasks) != 3 || !bytes.Equal(tasks[0].Actual, []byte{5}) || !bytes.Equal(tasks[2].Actual, []byte{8}) {
+		t.Errorf("unexpected tasks %+v", tasks)
+	}
+	if v, _ := net.Node(0x0001).Value("p"); !bytes.Equal(v, []byte{1}) {
+		t.Errorf("completed task was executed again")
+	}
+
+	// Node 0002 is replaced by a device with a different EUI-64, it leaves the
+	// special group and joins the replaced group
+	net.RemoveNode(0x0002)
+	net.AddNode(devsim.NewNode(0x0002, 0xCD00000000000002, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{0}}))
+	dpd = start()
+	time.AfterFunc(100*time.Millisecond, func() { net.Heartbeat(0x0002) })
+	tasks = waitDirector(t, dpd, path)
+	if len(tasks) != 2 || tasks[1].Address != 0x0002 || tasks[1].Parameter != "p" || !bytes.Equal(tasks[1].Actual, []byte{9}) ||
+		tasks[1].Meta["group"] != "replaced" || tasks[1].Meta["eui64"] != "CD00000000000002" {
+		t.Errorf("unexpected tasks %+v", tasks)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	net := devsim.NewNetwork()
+	net.AddNode(devsim.NewNode(0x0001, 1,
+		devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{5}},
+		devsim.Parameter{Name: "q", Type: dp.DP_TYPE_UINT8, Value: []byte{1}},
+		devsim.Parameter{Name: "r", Type: dp.DP_TYPE_UINT16, Value: []byte{0, 7}},
+		devsim.Parameter{Name: "t", Type: dp.DP_TYPE_STRING, Value: []byte("abc")}))
+	offline := devsim.NewNode(0x0002, 2, devsim.Parameter{Name: "p", Type: dp.DP_TYPE_UINT8, Value: []byte{0}})
+	offline.SetFaults(devsim.Faults{Offline: true})
+	net.AddNode(offline)
+	defer net.Close()
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	content := "address,parameter,type,desired,actual,info\n" +
+		"0001,p,u8,5,,\n" +
+		"0001,q,u8,2,,\n" +
+		"0001,r,u16,,,\n" +
+		"0001,s,u8,1,,\n" +
+		"0001,q,u16,1,,\n" +
+		"0001,t,nil,,,\n" +
+		"0001,p,u8,6,6,2019-01-01T12:00:01Z\n" +
+		"0002,p,u8,1,,\n" +
+		"0002,q,u8,1,,\n"
+	path := filepath.Join(t.TempDir(), "tasks.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dpd, err := NewDeviceParameterDirector(conn, 0x22, 0x5678, Timeout(50*time.Millisecond), Retries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := dpd.Plan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := plan.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := "node 0001\n" +
+		"     p u8: 5\n" +
+		"   ~ q u8: 1 -> 2\n" +
+		"  <= r u16: 7\n" +
+		"   ! s u8: -> 1 (No parameter \"s\" on device!)\n" +
+		"   ! q u16: -> 1 (node has type u8)\n" +
+		"   ~ t nil: abc -> \n" +
+		"\n" +
+		"node 0002\n" +
+		"   ? p u8: -> 1 (node did not respond)\n" +
+		"   ? q u8: -> 1 (not reached)\n" +
+		"\n" +
+		"Plan: 2 to change, 1 unchanged, 1 to read, 2 unknown, 2 failing, 1 skipped.\n"
+	if b.String() != expected {
+		t.Errorf("unexpected plan:\n%s", b.String())
+	}
+
+	if v, _ := net.Node(0x0001).Value("q"); !bytes.Equal(v, []byte{1}) {
+		t.Errorf("value was set")
+	}
+	if v, _ := net.Node(0x0001).Value("t"); string(v) != "abc" {
+		t.Errorf("value was set empty")
+	}
+	if data, _ := os.ReadFile(path); string(data) != content {
+		t.Errorf("task file was modified")
+	}
+}
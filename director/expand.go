@@ -0,0 +1,261 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "os"
+import "fmt"
+import "sort"
+import "time"
+import "bytes"
+import "errors"
+import "strconv"
+import "strings"
+
+import "github.com/proactivity-lab/go-moteconnection"
+
+import dp "github.com/thinnect/go-devparam"
+
+// Listen keeps a director that was started with a desired state running for
+// at least the given time, so that nodes joining the groups can be worked on
+// when their heartbeats are heard.
+func Listen(d time.Duration) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		previous := dpd.listen
+		dpd.listen = d
+		return Listen(previous), nil
+	}
+}
+
+// StartWithDesiredState compiles the desired state into the task file and
+// starts working on it. The tasks are compiled for the nodes listed in the
+// desired state, in the node list and in an existing task file, progress in
+// the task file is kept for tasks whose desired value has not changed. Nodes
+// that are heard from later and nodes whose EUI-64 becomes known or changes
+// are compiled again, their tasks are added, updated or removed according to
+// the groups they belong to. The node list is optional.
+func (dpd *DeviceParameterDirector) StartWithDesiredState(filepath string, state *DesiredState, nodelist string) error {
+	tasks, err := dpd.desiredTasks(filepath, state, nodelist)
+	if err != nil {
+		return err
+	}
+	if err := dpd.writeTasksToFile(tasks, filepath); err != nil {
+		return err
+	}
+	return dpd.Start(filepath)
+}
+
+// desiredTasks compiles the desired state and merges it with the task file.
+func (dpd *DeviceParameterDirector) desiredTasks(filepath string, state *DesiredState, nodelist string) ([]DeviceParameterTask, error) {
+	dpd.desired = state
+	dpd.members = make(map[moteconnection.AMAddr]NodeInfo)
+	dpd.stale = make(map[moteconnection.AMAddr]bool)
+	for _, info := range state.Known() {
+		dpd.members[info.Address] = info
+	}
+
+	if len(nodelist) > 0 {
+		nodes, err := dpd.readNodeFile(nodelist)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			if _, ok := dpd.members[node]; !ok {
+				dpd.members[node] = NodeInfo{Address: node}
+			}
+		}
+	}
+
+	existing := make([]DeviceParameterTask, 0)
+	if _, err := os.Stat(filepath); err == nil {
+		if existing, err = dpd.readTaskFile(filepath); err != nil {
+			return nil, err
+		}
+		for _, task := range existing {
+			info, ok := dpd.members[task.Address]
+			if !ok {
+				info = NodeInfo{Address: task.Address}
+			}
+			if eui64, err := strconv.ParseUint(task.Meta["eui64"], 16, 64); err == nil && info.Eui64 == 0 {
+				info.Eui64 = eui64
+			}
+			dpd.members[task.Address] = info
+		}
+	}
+
+	nodes := make([]moteconnection.AMAddr, 0, len(dpd.members))
+	for node := range dpd.members {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+
+	tasks := make([]DeviceParameterTask, 0)
+	for _, node := range nodes {
+		compiled, err := dpd.compileTasks(dpd.members[node])
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, mergeTasks(compiled, existing)...)
+	}
+	dpd.Debug.Printf("%d tasks compiled for %d nodes\n", len(tasks), len(nodes))
+	return tasks, nil
+}
+
+// compileTasks returns the tasks of the node according to the desired state,
+// types that are not given are taken from the schema.
+func (dpd *DeviceParameterDirector) compileTasks(node NodeInfo) ([]DeviceParameterTask, error) {
+	records := dpd.desired.Compile(node)
+	tasks := make([]DeviceParameterTask, 0, len(records))
+	for i := range records {
+		record := &records[i]
+		if len(record.Type) == 0 && dpd.schema != nil {
+			if ps := dpd.schema.Parameter(record.Parameter); ps != nil {
+				record.Type = ps.Type.String()
+			}
+		}
+		if len(record.Type) == 0 {
+			return nil, errors.New(fmt.Sprintf("Node %s parameter %s: type not specified!", node.Address, record.Parameter))
+		}
+		task, err := dpd.parseTask(record)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Node %s parameter %s: %s", node.Address, record.Parameter, err))
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func findTask(tasks []DeviceParameterTask, node moteconnection.AMAddr, parameter string) *DeviceParameterTask {
+	for i := range tasks {
+		if tasks[i].Address == node && tasks[i].Parameter == parameter {
+			return &tasks[i]
+		}
+	}
+	return nil
+}
+
+// mergeTasks keeps the existing tasks whose desired value has not changed, so
+// that their progress is not lost, and disabled tasks.
+func mergeTasks(compiled []DeviceParameterTask, existing []DeviceParameterTask) []DeviceParameterTask {
+	tasks := make([]DeviceParameterTask, 0, len(compiled))
+	for _, task := range compiled {
+		if old := findTask(existing, task.Address, task.Parameter); old != nil && (old.Disabled ||
+			(old.Type == task.Type && bytes.Equal(old.Desired, task.Desired))) {
+			meta := make(map[string]string)
+			for k, v := range old.Meta {
+				meta[k] = v
+			}
+			for k, v := range task.Meta {
+				meta[k] = v
+			}
+			task = *old
+			task.Meta = meta
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// expand marks a node that is heard from for the first time or whose EUI-64
+// becomes known or changes, as its groups may have changed. The tasks of the
+// node are compiled again by reexpand.
+func (dpd *DeviceParameterDirector) expand(hb *dp.DeviceHeartbeat) {
+	if dpd.desired == nil {
+		return
+	}
+
+	dpd.mutex.Lock()
+	defer dpd.mutex.Unlock()
+
+	info, known := dpd.members[hb.Address]
+	if known && (hb.Eui64 == 0 || info.Eui64 == hb.Eui64) {
+		return
+	}
+	info.Address = hb.Address
+	if hb.Eui64 != 0 {
+		info.Eui64 = hb.Eui64
+	}
+	dpd.members[hb.Address] = info
+	dpd.stale[hb.Address] = true
+}
+
+// reexpand replaces the tasks of the marked nodes with newly compiled ones.
+// Workers refer to tasks by their index, so it must only be called between
+// rounds with the mutex held.
+func (dpd *DeviceParameterDirector) reexpand() {
+	if dpd.desired == nil || len(dpd.stale) == 0 {
+		return
+	}
+
+	nodes := make([]moteconnection.AMAddr, 0, len(dpd.stale))
+	for node := range dpd.stale {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	dpd.stale = make(map[moteconnection.AMAddr]bool)
+
+	updated := false
+	for _, node := range nodes {
+		info := dpd.members[node]
+		compiled, err := dpd.compileTasks(info)
+		if err != nil {
+			dpd.Warning.Printf("Unable to compile tasks for node %s: %s\n", node, err)
+			continue
+		}
+
+		existing := make([]DeviceParameterTask, 0)
+		position := -1 // The tasks of the node are kept in place
+		for i, task := range dpd.tasks {
+			if task.Address == node {
+				if position < 0 {
+					position = i
+				}
+				existing = append(existing, task)
+			}
+		}
+		merged := mergeTasks(compiled, existing)
+
+		added, changed := 0, 0
+		for _, task := range merged {
+			if old := findTask(existing, node, task.Parameter); old == nil {
+				added++
+			} else if old.Type != task.Type || !bytes.Equal(old.Desired, task.Desired) {
+				changed++
+			}
+		}
+		removed := len(existing) - (len(merged) - added)
+		if added == 0 && changed == 0 && removed == 0 {
+			continue
+		}
+
+		tasks := make([]DeviceParameterTask, 0, len(dpd.tasks)-len(existing)+len(merged))
+		for i, task := range dpd.tasks {
+			if i == position {
+				tasks = append(tasks, merged...)
+			}
+			if task.Address != node {
+				tasks = append(tasks, task)
+			}
+		}
+		if position < 0 {
+			tasks = append(tasks, merged...)
+		}
+		dpd.tasks = tasks
+		updated = true
+
+		dpd.Info.Printf("Node %s belongs to %s, %d tasks added, %d changed, %d removed.\n",
+			node, strings.Join(dpd.desired.Membership(info), ", "), added, changed, removed)
+	}
+	if updated {
+		dpd.updateOutput()
+	}
+}
+
+// listening returns how long the director should still wait for new nodes
+// when all tasks are done.
+func (dpd *DeviceParameterDirector) listening() time.Duration {
+	if dpd.desired == nil {
+		return 0
+	}
+	return time.Until(dpd.started.Add(dpd.listen))
+}
@@ -0,0 +1,87 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "fmt"
+import "bytes"
+import "errors"
+import "strings"
+
+import dp "github.com/thinnect/go-devparam"
+
+// MismatchPolicy decides what happens when a node returns a different value
+// than the one that was set. The steps are taken in the order of the fields,
+// the zero value blocks the task right away.
+type MismatchPolicy struct {
+	Reread  bool // Read the value again, the returned value may have been stale
+	Retries int  // Number of times the set is repeated
+	Accept  bool // Accept the returned value if it is valid according to the schema, for example a clamped one
+}
+
+// Mismatch sets the policy for handling sets that return a different value.
+func Mismatch(p MismatchPolicy) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		if p.Retries < 0 {
+			return Mismatch(dpd.mismatch), errors.New(fmt.Sprintf("Mismatch retries must not be negative, not %d!", p.Retries))
+		}
+		previous := dpd.mismatch
+		dpd.mismatch = p
+		return Mismatch(previous), nil
+	}
+}
+
+// acceptedField is the additional task field that keeps the value accepted
+// by the mismatch policy, verification takes it as valid in place of the
+// desired value.
+const acceptedField = "accepted"
+
+// resolveMismatch applies the mismatch policy. It returns the value the task
+// is completed with, or the error the task fails with, and a description of
+// the decision for the info column.
+func (dpd *DeviceParameterDirector) resolveMismatch(dpm *dp.DeviceParameterManager, task *DeviceParameterTask, mismatch *dp.ValueMismatchError) (*dp.DeviceParameter, string, error) {
+	actual := mismatch.Actual
+	steps := make([]string, 0)
+	describe := func(decision string) string {
+		return fmt.Sprintf("%s: desired %s, actual %s", decision, dpd.valueText(task, task.Desired), dpd.valueText(task, actual))
+	}
+
+	if dpd.mismatch.Reread {
+		val, err := dpm.GetValueContext(dpd.ctx, task.Parameter)
+		if err != nil {
+			return nil, describe("re-read failed"), err
+		}
+		actual = val.Value
+		if bytes.Equal(val.Value, task.Desired) {
+			return val, describe("confirmed by re-read"), nil
+		}
+		steps = append(steps, "re-read")
+	}
+
+	for i := 1; i <= dpd.mismatch.Retries; i++ {
+		val, err := dpm.SetValueContext(dpd.ctx, task.Parameter, task.Desired)
+		if err == nil {
+			return val, describe(fmt.Sprintf("set on retry %d", i)), nil
+		}
+		var again *dp.ValueMismatchError
+		if !errors.As(err, &again) {
+			return nil, describe(fmt.Sprintf("retry %d failed", i)), err
+		}
+		actual = again.Actual
+		mismatch = again
+	}
+	if dpd.mismatch.Retries > 0 {
+		steps = append(steps, fmt.Sprintf("retried %d times", dpd.mismatch.Retries))
+	}
+
+	if dpd.mismatch.Accept {
+		if dpd.schema != nil && dpd.schema.Validate(task.Parameter, task.Type, actual) == nil {
+			task.setMeta(acceptedField, dpd.valueText(task, actual))
+			return &dp.DeviceParameter{Name: task.Parameter, Type: task.Type, Value: actual}, describe("accepted as valid in schema"), nil
+		}
+		steps = append(steps, "not valid in schema")
+	}
+
+	steps = append(steps, "blocked")
+	return nil, describe(strings.Join(steps, ", ")), mismatch
+}
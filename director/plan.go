@@ -0,0 +1,258 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "io"
+import "os"
+import "fmt"
+import "sync"
+import "bytes"
+import "errors"
+
+import "github.com/proactivity-lab/go-moteconnection"
+
+import dp "github.com/thinnect/go-devparam"
+
+// PlanAction is what the director would do with a task.
+type PlanAction int
+
+const (
+	PlanUnknown PlanAction = iota // The current value could not be read
+	PlanKeep                      // The value already matches
+	PlanChange                    // The value would be set
+	PlanRead                      // The value would only be read
+	PlanFail                      // The task would fail
+)
+
+func (action PlanAction) String() string {
+	switch action {
+	case PlanKeep:
+		return " "
+	case PlanChange:
+		return "~"
+	case PlanRead:
+		return "<="
+	case PlanFail:
+		return "!"
+	}
+	return "?"
+}
+
+// PlannedTask describes a task that the director would work on, values are
+// in the same form as in the task file.
+type PlannedTask struct {
+	Address   moteconnection.AMAddr
+	Parameter string
+	Type      dp.DeviceParameterType
+	Action    PlanAction
+	Desired   string
+	Current   string
+	Info      string // Why the value is not known or the task would fail
+}
+
+// Plan lists the pending tasks with the current values of the parameters.
+// Skipped counts the tasks that are completed or disabled.
+type Plan struct {
+	Tasks   []PlannedTask
+	Skipped int
+}
+
+// Count returns the number of tasks with the action.
+func (plan *Plan) Count(action PlanAction) int {
+	n := 0
+	for _, task := range plan.Tasks {
+		if task.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Write prints the plan with the tasks grouped by node.
+func (plan *Plan) Write(w io.Writer) error {
+	nodes := make([]moteconnection.AMAddr, 0)
+	tasks := make(map[moteconnection.AMAddr][]PlannedTask)
+	for _, task := range plan.Tasks {
+		if _, ok := tasks[task.Address]; !ok {
+			nodes = append(nodes, task.Address)
+		}
+		tasks[task.Address] = append(tasks[task.Address], task)
+	}
+
+	var b bytes.Buffer
+	for _, node := range nodes {
+		fmt.Fprintf(&b, "node %s\n", node)
+		for _, task := range tasks[node] {
+			fmt.Fprintf(&b, "%4s %s %s: ", task.Action, task.Parameter, task.Type)
+			switch task.Action {
+			case PlanKeep, PlanRead:
+				fmt.Fprintf(&b, "%s", task.Current)
+			case PlanChange:
+				fmt.Fprintf(&b, "%s -> %s", task.Current, task.Desired)
+			default:
+				if task.Type == dp.DP_TYPE_NIL || len(task.Desired) > 0 {
+					fmt.Fprintf(&b, "-> %s ", task.Desired)
+				}
+				fmt.Fprintf(&b, "(%s)", task.Info)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "Plan: %d to change, %d unchanged, %d to read, %d unknown, %d failing, %d skipped.\n",
+		plan.Count(PlanChange), plan.Count(PlanKeep), plan.Count(PlanRead), plan.Count(PlanUnknown), plan.Count(PlanFail), plan.Skipped)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Plan reads the current values of the parameters of the pending tasks in the
+// task file and reports what would be changed. Values are only read, nothing
+// is set and the task file is not modified.
+func (dpd *DeviceParameterDirector) Plan(filepath string) (*Plan, error) {
+	tasks, err := dpd.readTaskFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return dpd.plan(tasks), nil
+}
+
+// PlanWithTemplate is Plan for StartWithTemplate, the task file is not
+// created.
+func (dpd *DeviceParameterDirector) PlanWithTemplate(filepath string, template string, nodelist string) (*Plan, error) {
+	if _, err := os.Stat(filepath); err == nil {
+		dpd.Info.Printf("Task file exists, not using template.")
+		return dpd.Plan(filepath)
+	}
+	tasks, err := dpd.templateTasks(template, nodelist)
+	if err != nil {
+		return nil, err
+	}
+	return dpd.plan(tasks), nil
+}
+
+// PlanWithDesiredState is Plan for StartWithDesiredState, the task file is
+// not updated and nodes that are not yet known are not waited for.
+func (dpd *DeviceParameterDirector) PlanWithDesiredState(filepath string, state *DesiredState, nodelist string) (*Plan, error) {
+	tasks, err := dpd.desiredTasks(filepath, state, nodelist)
+	if err != nil {
+		return nil, err
+	}
+	return dpd.plan(tasks), nil
+}
+
+func (dpd *DeviceParameterDirector) plan(tasks []DeviceParameterTask) *Plan {
+	dpd.markVerify(tasks)
+
+	plan := new(Plan)
+	pending := make([]*DeviceParameterTask, 0) // Tasks in the order of the plan
+	nodes := make([]moteconnection.AMAddr, 0)
+	indices := make(map[moteconnection.AMAddr][]int) // Tasks of the node in the plan
+	for i := range tasks {
+		task := &tasks[i]
+		if !task.pending() {
+			plan.Skipped++
+			continue
+		}
+		if _, ok := indices[task.Address]; !ok {
+			nodes = append(nodes, task.Address)
+		}
+		indices[task.Address] = append(indices[task.Address], len(plan.Tasks))
+		pt := PlannedTask{Address: task.Address, Parameter: task.Parameter, Type: task.Type, Info: "not reached"}
+		if task.Desired != nil {
+			pt.Desired = dpd.valueText(task, task.Desired)
+		}
+		plan.Tasks = append(plan.Tasks, pt)
+		pending = append(pending, task)
+	}
+
+	client := dp.NewNodeParameterClient(dpd.conn, dpd.group, dpd.address)
+	client.SetLoggers(&dpd.DIWEloggers)
+	defer client.Close()
+
+	queue := make(chan moteconnection.AMAddr)
+	var wg sync.WaitGroup
+	for i := 0; i < dpd.concurrency && i < len(nodes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range queue {
+				dpd.planNode(client, node, pending, plan, indices[node])
+			}
+		}()
+	}
+	for _, node := range nodes {
+		if dpd.interrupted() {
+			break
+		}
+		queue <- node
+	}
+	close(queue)
+	wg.Wait()
+
+	return plan
+}
+
+// planNode reads the current values of the tasks of one node, a node that does
+// not respond is not tried for the rest of its tasks. Every node is handled by
+// a single worker, so the planned tasks of the node can be updated directly.
+func (dpd *DeviceParameterDirector) planNode(client *dp.NodeParameterClient, node moteconnection.AMAddr, tasks []*DeviceParameterTask, plan *Plan, indices []int) {
+	dpm, err := client.Manager(node)
+	if err != nil {
+		dpd.Error.Printf("Unable to communicate with node %s: %s\n", node, err)
+		return
+	}
+	defer dpm.Close()
+	dpm.SetTimeout(dpd.timeout)
+	dpm.SetRetries(int(dpd.retries))
+
+	for _, idx := range indices {
+		task := tasks[idx]
+		pt := &plan.Tasks[idx]
+
+		dpd.Debug.Printf("Plan %+v\n", *task)
+		val, err := dpm.GetValueContext(dpd.ctx, task.Parameter)
+		if err != nil {
+			if dpd.cancelled(err) {
+				break
+			}
+			pt.Info = err.Error()
+			var timeout *dp.TimeoutError
+			if errors.As(err, &timeout) {
+				pt.Info = "node did not respond"
+				break
+			}
+			if !dp.Temporary(err) {
+				pt.Action = PlanFail
+			}
+			continue
+		}
+
+		read := *task
+		read.Type = val.Type
+		pt.Current = dpd.valueText(&read, val.Value)
+		switch {
+		case task.Desired == nil && task.Type != dp.DP_TYPE_NIL:
+			pt.Action = PlanRead
+			pt.Type = val.Type
+		case task.Type == dp.DP_TYPE_NIL: // Any parameter can be set empty, the type is not compared
+			if len(val.Value) == 0 {
+				pt.Action = PlanKeep
+			} else {
+				pt.Action = PlanChange
+			}
+		case val.Type != task.Type:
+			pt.Action = PlanFail
+			pt.Info = fmt.Sprintf("node has type %s", val.Type)
+		case dpd.matches(task, val.Value):
+			pt.Action = PlanKeep
+		default:
+			pt.Action = PlanChange
+		}
+
+		if dpd.interrupted() {
+			break
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "sort"
+import "time"
+import "errors"
+
+import "github.com/proactivity-lab/go-moteconnection"
+
+import dp "github.com/thinnect/go-devparam"
+
+// NodeStatistics describes how well a node has been reachable during the run
+// of the director. Nodes that time out are backed off exponentially, a
+// response or an overheard heartbeat makes the node available again.
+type NodeStatistics struct {
+	Address moteconnection.AMAddr
+
+	Successes  int // Completed tasks
+	Failures   int // Failed tasks that the node did respond to
+	Timeouts   int // Tasks that the node did not respond to
+	Heartbeats int // Overheard heartbeats
+
+	ConsecutiveTimeouts int
+
+	LastSeen    time.Time // Last response or heartbeat
+	LastAttempt time.Time
+	NextAttempt time.Time // The node is not tried before this time when it has timed out
+}
+
+// Backoff sets the delay before retrying a node that did not respond, the
+// delay is doubled with every consecutive timeout up to max.
+func Backoff(min time.Duration, max time.Duration) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		if min < 0 || max < min {
+			return Backoff(dpd.backoffMin, dpd.backoffMax), errors.New("Backoff maximum must not be less than the minimum!")
+		}
+		previousMin, previousMax := dpd.backoffMin, dpd.backoffMax
+		dpd.backoffMin, dpd.backoffMax = min, max
+		return Backoff(previousMin, previousMax), nil
+	}
+}
+
+// Statistics returns the statistics of all nodes that have been worked on or
+// heard from, ordered by address.
+func (dpd *DeviceParameterDirector) Statistics() []NodeStatistics {
+	dpd.mutex.Lock()
+	defer dpd.mutex.Unlock()
+
+	stats := make([]NodeStatistics, 0, len(dpd.stats))
+	for _, st := range dpd.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	return stats
+}
+
+// nodeStatistics must be called with the mutex held.
+func (dpd *DeviceParameterDirector) nodeStatistics(node moteconnection.AMAddr) *NodeStatistics {
+	st, ok := dpd.stats[node]
+	if !ok {
+		st = &NodeStatistics{Address: node}
+		dpd.stats[node] = st
+	}
+	return st
+}
+
+// seen must be called with the mutex held.
+func (st *NodeStatistics) seen(t time.Time) {
+	if t.After(st.LastSeen) {
+		st.LastSeen = t
+	}
+	st.ConsecutiveTimeouts = 0
+	st.NextAttempt = time.Time{}
+}
+
+// recordResult updates the statistics with the outcome of a task, it must be
+// called with the mutex held.
+func (dpd *DeviceParameterDirector) recordResult(node moteconnection.AMAddr, err error) {
+	st := dpd.nodeStatistics(node)
+	now := time.Now()
+	st.LastAttempt = now
+
+	var timeout *dp.TimeoutError
+	var ce *dp.ContextError
+	var schema *dp.SchemaError
+	switch {
+	case err == nil:
+		st.Successes++
+		st.seen(now)
+	case errors.As(err, &timeout):
+		st.Timeouts++
+		st.ConsecutiveTimeouts++
+		st.NextAttempt = now.Add(dpd.backoff(st.ConsecutiveTimeouts))
+	case errors.As(err, &ce), errors.Is(err, dp.ErrClosed): // Interrupted, says nothing about the node
+	case errors.As(err, &schema): // Rejected before sending
+	default:
+		st.Failures++
+		st.seen(now)
+	}
+}
+
+// recordHeartbeat makes a node that has been backed off available again.
+func (dpd *DeviceParameterDirector) recordHeartbeat(hb *dp.DeviceHeartbeat) {
+	dpd.mutex.Lock()
+	st := dpd.nodeStatistics(hb.Address)
+	st.Heartbeats++
+	st.seen(hb.Timestamp)
+	dpd.mutex.Unlock()
+
+	select {
+	case dpd.wakeup <- true:
+	default:
+	}
+}
+
+func (dpd *DeviceParameterDirector) backoff(timeouts int) time.Duration {
+	backoff := dpd.backoffMin
+	for i := 1; i < timeouts && backoff < dpd.backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > dpd.backoffMax {
+		backoff = dpd.backoffMax
+	}
+	return backoff
+}
+
+// schedule orders the nodes so that responsive nodes are worked on first and
+// returns the nodes that can be tried now. If none can, the time when the next
+// one becomes available is returned. Must be called with the mutex held.
+func (dpd *DeviceParameterDirector) schedule(nodes []moteconnection.AMAddr) ([]moteconnection.AMAddr, time.Time) {
+	now := time.Now()
+	ready := make([]moteconnection.AMAddr, 0, len(nodes))
+	var next time.Time
+	for _, node := range nodes {
+		st := dpd.nodeStatistics(node)
+		if st.NextAttempt.After(now) {
+			if next.IsZero() || st.NextAttempt.Before(next) {
+				next = st.NextAttempt
+			}
+		} else {
+			ready = append(ready, node)
+		}
+	}
+
+	sort.SliceStable(ready, func(i, j int) bool {
+		a, b := dpd.stats[ready[i]], dpd.stats[ready[j]]
+		if a.ConsecutiveTimeouts != b.ConsecutiveTimeouts {
+			return a.ConsecutiveTimeouts < b.ConsecutiveTimeouts
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	return ready, next
+}
@@ -0,0 +1,349 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "io"
+import "fmt"
+import "sort"
+import "sync"
+import "bufio"
+import "bytes"
+import "errors"
+import "strings"
+import "path/filepath"
+
+import "encoding/csv"
+import "encoding/json"
+
+import "gopkg.in/yaml.v3"
+
+// TaskRecord is a task in text form, as it is stored in a task file. Values
+// are parsed and formatted by the director.
+type TaskRecord struct {
+	Address   string
+	Parameter string
+	Type      string
+	Desired   string
+	Actual    string
+	Info      string
+	Disabled  bool
+	Comment   string            // Free-form comment, may contain several lines
+	Meta      map[string]string // Additional fields, preserved when the file is updated
+}
+
+// TaskList is the content of a task file.
+type TaskList struct {
+	Tasks      []TaskRecord
+	Comment    string   // Comment that is not attached to a task
+	MetaFields []string // Order of the additional fields, if the format has one
+}
+
+// TaskStore reads and writes task files of a specific format.
+type TaskStore interface {
+	ReadTasks(r io.Reader) (*TaskList, error)
+	WriteTasks(w io.Writer, list *TaskList) error
+}
+
+var storeMutex sync.RWMutex
+
+var stores = map[string]TaskStore{
+	".csv":  CSVTaskStore{},
+	".json": JSONTaskStore{},
+	".yaml": YAMLTaskStore{},
+	".yml":  YAMLTaskStore{},
+}
+
+// RegisterTaskStore sets the store used for files with the extension, for
+// example ".csv", replacing the built-in store if there is one.
+func RegisterTaskStore(extension string, store TaskStore) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	stores[strings.ToLower(extension)] = store
+}
+
+// LookupTaskStore returns the store for the file, files with an unknown
+// extension are treated as CSV.
+func LookupTaskStore(path string) TaskStore {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	if store, ok := stores[strings.ToLower(filepath.Ext(path))]; ok {
+		return store
+	}
+	return CSVTaskStore{}
+}
+
+var csvHeader = []string{"address", "parameter", "type", "desired", "actual", "info"}
+
+// CSVTaskStore stores tasks with one task per line. Tasks are disabled by
+// putting a # in front of the address, lines starting with ## are comments
+// for the next task. Columns after info are additional fields, they must be
+// named in the header.
+type CSVTaskStore struct{}
+
+func (CSVTaskStore) ReadTasks(r io.Reader) (*TaskList, error) {
+	list := new(TaskList)
+
+	// Comments are separated before the CSV parser gets to see them
+	var data bytes.Buffer
+	comments := make(map[int][]string) // Line of the next record to comments
+	origin := make([]int, 0)           // Line in the file of every line the parser sees
+	pending := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "##") {
+			pending = append(pending, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "##")))
+			continue
+		}
+		origin = append(origin, number)
+		if len(pending) > 0 {
+			comments[len(origin)] = pending
+			pending = make([]string, 0)
+		}
+		data.WriteString(line)
+		data.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	list.Comment = strings.Join(pending, "\n")
+	fileLine := func(row int) int {
+		if 0 < row && row <= len(origin) {
+			return origin[row-1]
+		}
+		return row
+	}
+
+	reader := csv.NewReader(&data)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1 // Checked below, the header determines the number of fields
+
+	fields := len(csvHeader)
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				perr.StartLine = fileLine(perr.StartLine)
+				perr.Line = fileLine(perr.Line)
+			}
+			return nil, err
+		}
+		row, _ := reader.FieldPos(0)
+
+		if line[0] == "address" { // found the header
+			fields = len(line)
+			if fields < len(csvHeader) {
+				return nil, errors.New(fmt.Sprintf("Line %d: header must have at least %d fields!", fileLine(row), len(csvHeader)))
+			}
+			list.MetaFields = append([]string(nil), line[len(csvHeader):]...)
+			continue
+		}
+		if len(line) != fields {
+			return nil, errors.New(fmt.Sprintf("Line %d: %d fields instead of %d!", fileLine(row), len(line), fields))
+		}
+
+		record := TaskRecord{Address: line[0], Parameter: line[1], Type: line[2], Desired: line[3], Actual: line[4], Info: line[5]}
+		if strings.HasPrefix(record.Address, "#") {
+			record.Disabled = true
+			record.Address = record.Address[1:]
+		}
+		record.Comment = strings.Join(comments[row], "\n")
+		for i, name := range list.MetaFields {
+			if v := line[len(csvHeader)+i]; len(v) > 0 {
+				if record.Meta == nil {
+					record.Meta = make(map[string]string)
+				}
+				record.Meta[name] = v
+			}
+		}
+		list.Tasks = append(list.Tasks, record)
+	}
+	return list, nil
+}
+
+func (CSVTaskStore) WriteTasks(w io.Writer, list *TaskList) error {
+	bw := bufio.NewWriter(w)
+	cw := csv.NewWriter(bw)
+
+	meta := metaFields(list)
+	if err := cw.Write(append(append([]string(nil), csvHeader...), meta...)); err != nil {
+		return err
+	}
+
+	writeComment := func(comment string) {
+		cw.Flush()
+		for _, line := range strings.Split(comment, "\n") {
+			fmt.Fprintf(bw, "## %s\n", line)
+		}
+	}
+
+	for _, record := range list.Tasks {
+		if len(record.Comment) > 0 {
+			writeComment(record.Comment)
+		}
+		addr := record.Address
+		if record.Disabled {
+			addr = "#" + addr
+		}
+		line := []string{addr, record.Parameter, record.Type, record.Desired, record.Actual, record.Info}
+		for _, name := range meta {
+			line = append(line, record.Meta[name])
+		}
+		if err := cw.Write(line); err != nil {
+			return err
+		}
+	}
+	if len(list.Comment) > 0 {
+		writeComment(list.Comment)
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// metaFields lists the known additional fields first, followed by any new
+// ones in alphabetical order.
+func metaFields(list *TaskList) []string {
+	fields := append([]string(nil), list.MetaFields...)
+	known := make(map[string]bool)
+	for _, name := range fields {
+		known[name] = true
+	}
+	extra := make([]string, 0)
+	for _, record := range list.Tasks {
+		for name := range record.Meta {
+			if !known[name] {
+				known[name] = true
+				extra = append(extra, name)
+			}
+		}
+	}
+	sort.Strings(extra)
+	return append(fields, extra...)
+}
+
+// taskDocument is the structure of JSON and YAML task files, tasks are
+// grouped by node.
+type taskDocument struct {
+	Comment string      `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Nodes   []nodeTasks `json:"nodes" yaml:"nodes"`
+}
+
+type nodeTasks struct {
+	Address text        `json:"address" yaml:"address"`
+	Tasks   []taskEntry `json:"tasks" yaml:"tasks"`
+}
+
+type taskEntry struct {
+	Parameter string            `json:"parameter" yaml:"parameter"`
+	Type      string            `json:"type" yaml:"type"`
+	Desired   text              `json:"desired,omitempty" yaml:"desired,omitempty"`
+	Actual    text              `json:"actual,omitempty" yaml:"actual,omitempty"`
+	Info      string            `json:"info,omitempty" yaml:"info,omitempty"`
+	Disabled  bool              `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Comment   string            `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty" yaml:"meta,omitempty"`
+}
+
+// text accepts JSON numbers and booleans in addition to strings, so that
+// values do not have to be quoted.
+type text string
+
+func (t *text) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = text(s)
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v.(type) {
+	case float64, bool:
+		*t = text(strings.TrimSpace(string(data)))
+		return nil
+	}
+	return errors.New(fmt.Sprintf("%s is not a valid value!", data))
+}
+
+func (doc *taskDocument) list() *TaskList {
+	list := &TaskList{Comment: doc.Comment}
+	for _, node := range doc.Nodes {
+		for _, e := range node.Tasks {
+			list.Tasks = append(list.Tasks, TaskRecord{
+				Address: string(node.Address), Parameter: e.Parameter, Type: e.Type,
+				Desired: string(e.Desired), Actual: string(e.Actual), Info: e.Info,
+				Disabled: e.Disabled, Comment: e.Comment, Meta: e.Meta})
+		}
+	}
+	return list
+}
+
+// newTaskDocument groups the tasks by node, nodes are listed in the order of
+// their first task.
+func newTaskDocument(list *TaskList) *taskDocument {
+	doc := &taskDocument{Comment: list.Comment, Nodes: make([]nodeTasks, 0)}
+	index := make(map[string]int)
+	for _, r := range list.Tasks {
+		i, ok := index[r.Address]
+		if !ok {
+			i = len(doc.Nodes)
+			index[r.Address] = i
+			doc.Nodes = append(doc.Nodes, nodeTasks{Address: text(r.Address)})
+		}
+		doc.Nodes[i].Tasks = append(doc.Nodes[i].Tasks, taskEntry{
+			Parameter: r.Parameter, Type: r.Type, Desired: text(r.Desired), Actual: text(r.Actual),
+			Info: r.Info, Disabled: r.Disabled, Comment: r.Comment, Meta: r.Meta})
+	}
+	return doc
+}
+
+// JSONTaskStore stores tasks grouped by node in a JSON document.
+type JSONTaskStore struct{}
+
+func (JSONTaskStore) ReadTasks(r io.Reader) (*TaskList, error) {
+	doc := new(taskDocument)
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(doc); err != nil {
+		return nil, err
+	}
+	return doc.list(), nil
+}
+
+func (JSONTaskStore) WriteTasks(w io.Writer, list *TaskList) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(newTaskDocument(list))
+}
+
+// YAMLTaskStore stores tasks grouped by node in a YAML document. YAML
+// comments are not preserved, the comment fields must be used instead.
+type YAMLTaskStore struct{}
+
+func (YAMLTaskStore) ReadTasks(r io.Reader) (*TaskList, error) {
+	doc := new(taskDocument)
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return doc.list(), nil
+}
+
+func (YAMLTaskStore) WriteTasks(w io.Writer, list *TaskList) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(newTaskDocument(list)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,72 @@
+// Author  Raido Pahtma
+// License MIT
+
+package director
+
+import "fmt"
+import "time"
+import "bytes"
+
+import dp "github.com/thinnect/go-devparam"
+
+// Verify makes the director read the values of completed tasks again when it
+// is started. Values that no longer match the desired value, for example
+// after a node has rebooted with defaults, are set again. A value that was
+// accepted by the mismatch policy is taken as valid as well.
+func Verify(v bool) option {
+	return func(dpd *DeviceParameterDirector) (option, error) {
+		previous := dpd.verify
+		dpd.verify = v
+		return Verify(previous), nil
+	}
+}
+
+// verifyTask reads the value of a completed task. When the value has drifted
+// from the desired or the accepted one, the task is reopened and the drift is
+// described.
+func (dpd *DeviceParameterDirector) verifyTask(dpm *dp.DeviceParameterManager, task *DeviceParameterTask) (string, error) {
+	val, err := dpm.GetValueContext(dpd.ctx, task.Parameter)
+	if err != nil {
+		return "", err
+	}
+	task.Verify = false
+
+	if (task.Desired == nil && task.Type != dp.DP_TYPE_NIL) || dpd.matches(task, val.Value) {
+		task.Type = val.Type
+		task.Actual = val.Value
+		task.Info = time.Now().UTC().Format("2006-01-02T15:04:05Z") + " verified"
+		dpd.Info.Printf("Verified parameter %s on node %s.\n", task.Parameter, task.Address)
+		return "", nil
+	}
+
+	from := dpd.valueText(task, task.Desired)
+	if accepted, ok := task.Meta[acceptedField]; ok {
+		from = accepted
+	}
+	drift := fmt.Sprintf("drifted from %s to %s", from, dpd.valueText(task, val.Value))
+	dpd.Warning.Printf("Parameter %s on node %s %s.\n", task.Parameter, task.Address, drift)
+	task.Actual = nil
+	return drift, nil
+}
+
+// matches tells whether the value needs no action, it is the desired value or
+// the one that the mismatch policy accepted in its place.
+func (dpd *DeviceParameterDirector) matches(task *DeviceParameterTask, value []byte) bool {
+	if bytes.Equal(value, task.Desired) {
+		return true
+	}
+	if text, ok := task.Meta[acceptedField]; ok {
+		accepted, err := dpd.parseValue(task, text)
+		return err == nil && bytes.Equal(value, accepted)
+	}
+	return false
+}
+
+// markVerify marks the completed tasks for verification if verify is on.
+func (dpd *DeviceParameterDirector) markVerify(tasks []DeviceParameterTask) {
+	if dpd.verify {
+		for i := range tasks {
+			tasks[i].Verify = tasks[i].Disabled == false && tasks[i].Actual != nil
+		}
+	}
+}
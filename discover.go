@@ -0,0 +1,58 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "time"
+import "errors"
+import "context"
+
+// DiscoverSchema enumerates all parameters of the device and returns them as
+// a schema. The schema is a snapshot, it also contains the sequence numbers,
+// lengths and current values of the parameters and the EUI-64 of the device,
+// if a heartbeat has been received.
+func (self *DeviceParameterManager) DiscoverSchema() (*Schema, error) {
+	return self.DiscoverSchemaContext(context.Background())
+}
+
+func (self *DeviceParameterManager) DiscoverSchemaContext(ctx context.Context) (*Schema, error) {
+	ctx, cancel := context.WithCancel(ctx) // Stops the enumeration when returning early
+	defer cancel()
+
+	pchan, err := self.GetListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := new(Schema)
+	for param := range pchan {
+		if param.Error != nil {
+			return nil, errors.New(fmt.Sprintf("Parameter %d: %s", param.Seqnum, param.Error))
+		}
+		seqnum := param.Seqnum
+		ps := &ParameterSchema{Name: param.Name, Type: param.Type, Seqnum: &seqnum, Length: len(param.Value)}
+		if ps.Value, err = ParameterValueString(param.Type, param.Value); err != nil {
+			return nil, errors.New(fmt.Sprintf("Parameter \"%s\": %s", param.Name, err))
+		}
+		schema.Parameters = append(schema.Parameters, ps)
+	}
+
+	if err := ctx.Err(); err != nil { // The list is incomplete
+		return nil, NewContextError("Discover schema", err)
+	}
+	if self.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if eui64 := self.Eui64(); eui64 != 0 {
+		schema.Eui64 = fmt.Sprintf("%016X", eui64)
+	}
+	captured := time.Now().UTC()
+	schema.Captured = &captured
+
+	if err := schema.Init(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
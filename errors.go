@@ -0,0 +1,181 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "errors"
+
+var ErrClosed = errors.New("DeviceParameterManager has been closed!")
+
+// All errors are returned as pointers, use errors.As with a pointer to a
+// pointer of the error type to check for a specific kind of failure.
+
+// ParameterError reports that the parameter does not exist on the device.
+type ParameterError struct{ s string }
+
+// InvalidParameterValueError reports that the device rejected the value,
+// it wraps the DeviceError when the device reported EINVAL.
+type InvalidParameterValueError struct {
+	s   string
+	err error
+}
+
+// ValueMismatchError reports that the device accepted a set request, but
+// returned a value that differs from the one that was set.
+type ValueMismatchError struct {
+	s       string
+	Desired []byte
+	Actual  []byte
+}
+
+// TimeoutError reports that the device did not respond in time.
+type TimeoutError struct{ s string }
+
+// ContextError reports a cancelled or expired context, errors.Is can be used
+// to check for context.Canceled and context.DeadlineExceeded.
+type ContextError struct {
+	s   string
+	err error
+}
+
+// SchemaError reports that a parameter or value does not conform to the schema,
+// nothing is sent to the device in that case.
+type SchemaError struct {
+	s    string
+	Name string
+}
+
+// TypeMismatchError reports that the device has a different type for the
+// parameter than the one requested through the typed value functions.
+type TypeMismatchError struct {
+	s        string
+	Name     string
+	Expected DeviceParameterType
+	Actual   DeviceParameterType
+}
+
+func (self *ParameterError) Error() string             { return self.s }
+func NewParameterError(text string) error              { return &ParameterError{text} }
+func (self *InvalidParameterValueError) Error() string { return self.s }
+func (self *InvalidParameterValueError) Unwrap() error { return self.err }
+func NewInvalidParameterValueError(text string) error  { return &InvalidParameterValueError{text, nil} }
+func (self *ValueMismatchError) Error() string         { return self.s }
+func NewValueMismatchError(text string) error          { return &ValueMismatchError{text, nil, nil} }
+func (self *TimeoutError) Error() string               { return self.s }
+func (self *TimeoutError) Temporary() bool             { return true }
+func NewTimeoutError(text string) error                { return &TimeoutError{text} }
+func (self *ContextError) Error() string               { return self.s + ": " + self.err.Error() }
+func (self *ContextError) Unwrap() error               { return self.err }
+func NewContextError(text string, err error) error     { return &ContextError{text, err} }
+func (self *TypeMismatchError) Error() string          { return self.s }
+func (self *SchemaError) Error() string                { return self.s }
+
+func newValueMismatchError(desired []byte, actual []byte) error {
+	return &ValueMismatchError{fmt.Sprintf("Returned value %X does not match set value %X!", actual, desired), desired, actual}
+}
+
+func newSchemaError(name string, format string, args ...interface{}) error {
+	return &SchemaError{fmt.Sprintf("Parameter \"%s\" ", name) + fmt.Sprintf(format, args...), name}
+}
+
+func newTypeMismatchError(name string, expected DeviceParameterType, actual DeviceParameterType) error {
+	return &TypeMismatchError{fmt.Sprintf("Parameter \"%s\" is %s, not %s!", name, actual, expected), name, expected, actual}
+}
+
+// Temporary reports if a failed request may succeed when it is repeated later.
+// Timeouts and transient device errors are temporary, missing parameters,
+// rejected values, cancellations and a closed manager are not.
+func Temporary(err error) bool {
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	return false
+}
+
+// DeviceErrorCode is a TinyOS error_t value reported by the device.
+// The codes can be used as sentinels with errors.Is.
+type DeviceErrorCode uint8
+
+const (
+	ErrFail     DeviceErrorCode = 1  // FAIL - Generic condition: backwards compatible
+	ErrSize     DeviceErrorCode = 2  // ESIZE - Parameter passed in was too big
+	ErrCancel   DeviceErrorCode = 3  // ECANCEL - Operation cancelled by a call
+	ErrOff      DeviceErrorCode = 4  // EOFF - Subsystem is not active
+	ErrBusy     DeviceErrorCode = 5  // EBUSY - The underlying system is busy; retry later
+	ErrInvalid  DeviceErrorCode = 6  // EINVAL - An invalid parameter was passed
+	ErrRetry    DeviceErrorCode = 7  // ERETRY - A rare and transient failure: can retry
+	ErrReserve  DeviceErrorCode = 8  // ERESERVE - Reservation required before usage
+	ErrAlready  DeviceErrorCode = 9  // EALREADY - The device state you are requesting is already set
+	ErrNoMemory DeviceErrorCode = 10 // ENOMEM - Memory required not available
+	ErrNoAck    DeviceErrorCode = 11 // ENOACK - A packet was not acknowledged
+)
+
+var DeviceErrorCodeToString = map[DeviceErrorCode]string{
+	ErrFail:     "FAIL",
+	ErrSize:     "ESIZE",
+	ErrCancel:   "ECANCEL",
+	ErrOff:      "EOFF",
+	ErrBusy:     "EBUSY",
+	ErrInvalid:  "EINVAL",
+	ErrRetry:    "ERETRY",
+	ErrReserve:  "ERESERVE",
+	ErrAlready:  "EALREADY",
+	ErrNoMemory: "ENOMEM",
+	ErrNoAck:    "ENOACK",
+}
+
+func (code DeviceErrorCode) String() string {
+	if s, ok := DeviceErrorCodeToString[code]; ok {
+		return s
+	}
+	return fmt.Sprintf("E%d", uint8(code))
+}
+
+func (code DeviceErrorCode) Error() string {
+	return code.String()
+}
+
+// Temporary reports if the condition is likely to pass and repeating the
+// request later may succeed.
+func (code DeviceErrorCode) Temporary() bool {
+	switch code {
+	case ErrBusy, ErrRetry, ErrNoMemory, ErrNoAck, ErrOff, ErrReserve:
+		return true
+	}
+	return false
+}
+
+// DeviceError is an error reported by the device for an existing parameter.
+type DeviceError struct {
+	Name     string // Parameter name, when addressed by name
+	Seqnum   uint8  // Parameter sequence number, when addressed by seqnum
+	BySeqnum bool
+	Code     DeviceErrorCode
+}
+
+func (self *DeviceError) Error() string {
+	if self.BySeqnum {
+		return fmt.Sprintf("Something went wrong with parameter %d, error %d - %s!", self.Seqnum, uint8(self.Code), self.Code)
+	}
+	return fmt.Sprintf("Something went wrong with parameter \"%s\", error %d - %s!", self.Name, uint8(self.Code), self.Code)
+}
+
+func (self *DeviceError) Unwrap() error   { return self.Code }
+func (self *DeviceError) Temporary() bool { return self.Code.Temporary() }
+func NewDeviceError(name string, code DeviceErrorCode) error {
+	return newDeviceError(&DeviceError{Name: name, Code: code})
+}
+func NewDeviceSeqnumError(seqnum uint8, code DeviceErrorCode) error {
+	return newDeviceError(&DeviceError{Seqnum: seqnum, BySeqnum: true, Code: code})
+}
+
+// EINVAL has historically been reported as InvalidParameterValueError, which
+// now wraps the DeviceError.
+func newDeviceError(de *DeviceError) error {
+	if de.Code == ErrInvalid {
+		return &InvalidParameterValueError{de.Error(), de}
+	}
+	return de
+}
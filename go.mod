@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/proactivity-lab/go-loggers v0.0.0-20180417085828-f892709079bd
 	github.com/proactivity-lab/go-moteconnection v0.0.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
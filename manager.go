@@ -6,12 +6,22 @@ package deviceparameters
 import "fmt"
 import "time"
 import "errors"
+import "context"
+import "sync"
 import "bytes"
-import "encoding/binary"
 
 import "github.com/proactivity-lab/go-loggers"
 import "github.com/proactivity-lab/go-moteconnection"
 
+type DeviceHeartbeat struct {
+	Address     moteconnection.AMAddr // Source of the heartbeat, 0 for serial devices
+	Eui64       uint64
+	Uptime      time.Duration
+	Timestamp   time.Time
+	DeviceStart time.Time // Computed from Timestamp and Uptime
+	Reboot      bool      // The device has restarted or been replaced since the previous heartbeat
+}
+
 type DeviceParameter struct {
 	Name      string
 	Type      DeviceParameterType
@@ -24,55 +34,82 @@ type DeviceParameter struct {
 const TOS_SERIAL_DEVICE_PARAMETERS_ID = 0x80
 const AMID_DEVICE_PARAMETERS = 0x82
 
+// Uptime is reported in seconds and heartbeats may be delayed on the way, so
+// the computed device start time is allowed to move forward by this much
+// before it is considered to be a reboot.
+const REBOOT_DETECTION_TOLERANCE = 5 * time.Second
+
 type DeviceParameterManager struct {
 	loggers.DIWEloggers
 	sfc moteconnection.MoteConnection
 	dsp moteconnection.Dispatcher
 
-	values    map[string]*DeviceParameter
+	mutex sync.Mutex // Guards the fields below that are shared between callers and the run goroutine
+
+	values    map[string]*DeviceParameter // Last known values, cleared on reboot
 	devstart  time.Time
 	heartbeat time.Time
+	eui64     uint64
+
+	heartbeatSubscribers []chan *DeviceHeartbeat
+	parameterSubscribers []*parameterSubscriber
 
 	timeout time.Duration
 	retries int
+	schema  *Schema
+
+	closed bool
 
-	receive chan moteconnection.Packet
+	receive  chan moteconnection.Packet
+	requests chan *request
 
 	destination moteconnection.AMAddr // Optional destination
 
-	done   chan bool
-	closed bool
+	detach func() // Set when the dispatcher is shared through a NodeParameterClient
+
+	done    chan bool // Closed by Close
+	stopped chan bool // Closed by the run goroutine when it exits
 }
 
-type ParameterError struct{ s string }
-type InvalidParameterValueError struct{ s string }
-type ValueMismatchError struct{ s string }
-type TimeoutError struct{ s string }
+// request is an operation executed by the run goroutine on behalf of a caller.
+type request struct {
+	ctx    context.Context
+	action func(ctx context.Context) (*DeviceParameter, error)
+	result chan response
+}
 
-func (self ParameterError) Error() string             { return self.s }
-func NewParameterError(text string) error             { return &ParameterError{text} }
-func (self InvalidParameterValueError) Error() string { return self.s }
-func NewInvalidParameterValueError(text string) error { return &InvalidParameterValueError{text} }
-func (self ValueMismatchError) Error() string         { return self.s }
-func NewValueMismatchError(text string) error         { return &ValueMismatchError{text} }
-func (self TimeoutError) Error() string               { return self.s }
-func NewTimeoutError(text string) error               { return &TimeoutError{text} }
+type response struct {
+	dp  *DeviceParameter
+	err error
+}
 
-func NewDeviceParameterManager(sfc moteconnection.MoteConnection) *DeviceParameterManager {
+type parameterSubscriber struct {
+	name    string // Parameter name or "*" for all parameters
+	updates chan *DeviceParameter
+}
+
+func newDeviceParameterManager(sfc moteconnection.MoteConnection) *DeviceParameterManager {
 	dpm := new(DeviceParameterManager)
 	dpm.InitLoggers()
 	dpm.values = make(map[string]*DeviceParameter)
 	dpm.done = make(chan bool)
+	dpm.stopped = make(chan bool)
 	dpm.closed = false
 	dpm.receive = make(chan moteconnection.Packet)
+	dpm.requests = make(chan *request, 16)
 	dpm.timeout = time.Second
 	dpm.retries = 3
+	dpm.sfc = sfc
+	return dpm
+}
+
+func NewDeviceParameterManager(sfc moteconnection.MoteConnection) *DeviceParameterManager {
+	dpm := newDeviceParameterManager(sfc)
 
 	dsp := moteconnection.NewPacketDispatcher(moteconnection.NewRawPacket(TOS_SERIAL_DEVICE_PARAMETERS_ID))
 	dsp.RegisterReceiver(dpm.receive)
 	dpm.dsp = dsp
 
-	dpm.sfc = sfc
 	dpm.sfc.AddDispatcher(dpm.dsp)
 
 	go dpm.run()
@@ -80,21 +117,13 @@ func NewDeviceParameterManager(sfc moteconnection.MoteConnection) *DeviceParamet
 }
 
 func NewDeviceParameterActiveMessageManager(sfc moteconnection.MoteConnection, group moteconnection.AMGroup, address moteconnection.AMAddr, destination moteconnection.AMAddr) *DeviceParameterManager {
-	dpm := new(DeviceParameterManager)
-	dpm.InitLoggers()
-	dpm.values = make(map[string]*DeviceParameter)
-	dpm.done = make(chan bool)
-	dpm.closed = false
-	dpm.receive = make(chan moteconnection.Packet)
-	dpm.timeout = time.Second
-	dpm.retries = 3
+	dpm := newDeviceParameterManager(sfc)
 	dpm.destination = destination
 
 	dsp := moteconnection.NewMessageDispatcher(moteconnection.NewMessage(group, address))
 	dsp.RegisterMessageReceiver(AMID_DEVICE_PARAMETERS, dpm.receive)
 	dpm.dsp = dsp
 
-	dpm.sfc = sfc
 	dpm.sfc.AddDispatcher(dpm.dsp)
 
 	go dpm.run()
@@ -102,26 +131,103 @@ func NewDeviceParameterActiveMessageManager(sfc moteconnection.MoteConnection, g
 }
 
 func (self *DeviceParameterManager) SetTimeout(timeout time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	self.timeout = timeout
 }
 
 func (self *DeviceParameterManager) SetRetries(retries int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	self.retries = retries
 }
 
+// SetSchema makes SetValue and SetValueBySeqnum check values against the
+// schema before sending them, nil disables the checks.
+func (self *DeviceParameterManager) SetSchema(schema *Schema) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.schema = schema
+}
+
+func (self *DeviceParameterManager) Schema() *Schema {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.schema
+}
+
+func (self *DeviceParameterManager) settings() (time.Duration, int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.timeout, self.retries
+}
+
+func (self *DeviceParameterManager) isClosed() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.closed
+}
+
+// execute queues an action for the run goroutine and waits for the result.
+// Actions are executed one at a time in the order they were queued.
+func (self *DeviceParameterManager) execute(ctx context.Context, description string, action func(ctx context.Context) (*DeviceParameter, error)) (*DeviceParameter, error) {
+	if self.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, NewContextError(description, err)
+	}
+
+	req := &request{ctx, action, make(chan response, 1)}
+	select {
+	case self.requests <- req:
+	case <-self.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, NewContextError(description, ctx.Err())
+	}
+
+	select {
+	case r := <-req.result:
+		return r.dp, r.err
+	case <-self.stopped:
+		select { // The result may have been delivered just before stopping
+		case r := <-req.result:
+			return r.dp, r.err
+		default:
+		}
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, NewContextError(description, ctx.Err())
+	}
+}
+
+func (self *DeviceParameterManager) newPacket() moteconnection.Packet {
+	msg := self.dsp.NewPacket()
+	if self.destination != 0 {
+		msg.(*moteconnection.Message).SetDestination(self.destination)
+		msg.(*moteconnection.Message).SetType(AMID_DEVICE_PARAMETERS)
+	}
+	return msg
+}
+
 func (self *DeviceParameterManager) GetValue(name string) (*DeviceParameter, error) {
-	// Interrupt the run goroutine
-	self.done <- true
+	return self.GetValueContext(context.Background(), name)
+}
+
+func (self *DeviceParameterManager) GetValueContext(ctx context.Context, name string) (*DeviceParameter, error) {
+	return self.execute(ctx, fmt.Sprintf("Get parameter \"%s\"", name), func(ctx context.Context) (*DeviceParameter, error) {
+		return self.getValue(ctx, name)
+	})
+}
 
+func (self *DeviceParameterManager) getValue(ctx context.Context, name string) (*DeviceParameter, error) {
 	var result error = errors.New("disabled")
 
-	for retries := 0; retries <= self.retries; retries++ {
+	_, retries := self.settings()
+	for retry := 0; retry <= retries; retry++ {
 		// Send get request
-		msg := self.dsp.NewPacket()
-		if self.destination != 0 {
-			msg.(*moteconnection.Message).SetDestination(self.destination)
-			msg.(*moteconnection.Message).SetType(AMID_DEVICE_PARAMETERS)
-		}
+		msg := self.newPacket()
 		payload := new(DpGetParameterId)
 		payload.Header = DP_GET_PARAMETER_WITH_ID
 		payload.Id = name
@@ -129,35 +235,78 @@ func (self *DeviceParameterManager) GetValue(name string) (*DeviceParameter, err
 		self.sfc.Send(msg)
 
 		// Wait for value
-		dp, err := self.waitValueId(name)
+		dp, err := self.waitValueId(ctx, name)
 		if err == nil {
-			go self.run()
 			return dp, nil
 		} else {
 			result = err
-			if _, ok := err.(*ParameterError); ok {
+			if !retryable(err) {
 				break
 			}
 		}
 	}
 
-	go self.run()
 	return nil, result
 }
 
+// GetCachedValue returns the cached value of the parameter if it is not older
+// than maxAge, otherwise the value is queried from the device. The cache is
+// updated by all responses and reports received from the device and cleared
+// when the device is detected to have rebooted.
+func (self *DeviceParameterManager) GetCachedValue(name string, maxAge time.Duration) (*DeviceParameter, error) {
+	return self.GetCachedValueContext(context.Background(), name, maxAge)
+}
+
+func (self *DeviceParameterManager) GetCachedValueContext(ctx context.Context, name string, maxAge time.Duration) (*DeviceParameter, error) {
+	if dp := self.CachedValue(name); dp != nil && time.Since(dp.Timestamp) <= maxAge {
+		return dp, nil
+	}
+	return self.GetValueContext(ctx, name)
+}
+
+// CachedValue returns the last known value of the parameter without querying
+// the device, nil if the value is not known.
+func (self *DeviceParameterManager) CachedValue(name string) *DeviceParameter {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if dp, ok := self.values[name]; ok {
+		cached := *dp
+		cached.Value = append([]byte(nil), dp.Value...)
+		return &cached
+	}
+	return nil
+}
+
+func (self *DeviceParameterManager) cacheValue(dp *DeviceParameter) {
+	cached := *dp
+	cached.Value = append([]byte(nil), dp.Value...)
+	self.mutex.Lock()
+	self.values[dp.Name] = &cached
+	self.mutex.Unlock()
+}
+
 func (self *DeviceParameterManager) SetValue(name string, value []byte) (*DeviceParameter, error) {
-	// Interrupt the run goroutine
-	self.done <- true
+	return self.SetValueContext(context.Background(), name, value)
+}
 
+func (self *DeviceParameterManager) SetValueContext(ctx context.Context, name string, value []byte) (*DeviceParameter, error) {
+	if schema := self.Schema(); schema != nil {
+		if err := schema.ValidateValue(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return self.execute(ctx, fmt.Sprintf("Set parameter \"%s\"", name), func(ctx context.Context) (*DeviceParameter, error) {
+		return self.setValue(ctx, name, value)
+	})
+}
+
+func (self *DeviceParameterManager) setValue(ctx context.Context, name string, value []byte) (*DeviceParameter, error) {
 	var result error = errors.New("disabled")
 
-	for retries := 0; retries <= self.retries; retries++ {
+	_, retries := self.settings()
+	for retry := 0; retry <= retries; retry++ {
 		// Send set request
-		msg := self.dsp.NewPacket()
-		if self.destination != 0 {
-			msg.(*moteconnection.Message).SetDestination(self.destination)
-			msg.(*moteconnection.Message).SetType(AMID_DEVICE_PARAMETERS)
-		}
+		msg := self.newPacket()
 		payload := new(DpSetParameterId)
 		payload.Header = DP_SET_PARAMETER_WITH_ID
 		payload.Id = name
@@ -166,39 +315,113 @@ func (self *DeviceParameterManager) SetValue(name string, value []byte) (*Device
 		self.sfc.Send(msg)
 
 		// Wait for value
-		dp, err := self.waitValueId(name)
+		dp, err := self.waitValueId(ctx, name)
 		if err == nil {
 			if bytes.Compare(dp.Value, value) == 0 {
-				// store in values table
-				self.values[name] = dp
-				go self.run()
 				return dp, nil
 			} else {
-				go self.run()
-				return dp, NewValueMismatchError(fmt.Sprintf("Returned value %X does not match set value %X!", dp.Value, value))
+				return dp, newValueMismatchError(value, dp.Value)
 			}
 		} else {
 			result = err
-			if _, ok := err.(*ParameterError); ok {
+			if !retryable(err) {
 				break
 			}
 		}
 	}
 
-	go self.run()
 	return nil, result
 }
 
+// GetValueBySeqnum queries a parameter by its sequence number, as learned
+// from GetList, which keeps the request packet small.
+func (self *DeviceParameterManager) GetValueBySeqnum(seqnum uint8) (*DeviceParameter, error) {
+	return self.GetValueBySeqnumContext(context.Background(), seqnum)
+}
+
+func (self *DeviceParameterManager) GetValueBySeqnumContext(ctx context.Context, seqnum uint8) (*DeviceParameter, error) {
+	return self.execute(ctx, fmt.Sprintf("Get parameter %d", seqnum), func(ctx context.Context) (*DeviceParameter, error) {
+		return self.getValueSeqnum(ctx, seqnum)
+	})
+}
+
+// SetValueBySeqnum sets a parameter by its sequence number, as learned from
+// GetList, which keeps the request packet small. With a schema the value is
+// validated as in SetValue, the name of the parameter is then taken from the
+// schema or the cache, or queried from the device.
+func (self *DeviceParameterManager) SetValueBySeqnum(seqnum uint8, value []byte) (*DeviceParameter, error) {
+	return self.SetValueBySeqnumContext(context.Background(), seqnum, value)
+}
+
+func (self *DeviceParameterManager) SetValueBySeqnumContext(ctx context.Context, seqnum uint8, value []byte) (*DeviceParameter, error) {
+	if schema := self.Schema(); schema != nil {
+		name, err := self.seqnumName(ctx, schema, seqnum)
+		if err != nil {
+			return nil, err
+		}
+		if err := schema.ValidateValue(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return self.execute(ctx, fmt.Sprintf("Set parameter %d", seqnum), func(ctx context.Context) (*DeviceParameter, error) {
+		return self.setValueSeqnum(ctx, seqnum, value)
+	})
+}
+
+// seqnumName returns the name of the parameter with the sequence number.
+func (self *DeviceParameterManager) seqnumName(ctx context.Context, schema *Schema, seqnum uint8) (string, error) {
+	for _, ps := range schema.Parameters {
+		if ps.Seqnum != nil && *ps.Seqnum == seqnum {
+			return ps.Name, nil
+		}
+	}
+	self.mutex.Lock()
+	for _, dp := range self.values {
+		if dp.Seqnum == seqnum {
+			self.mutex.Unlock()
+			return dp.Name, nil
+		}
+	}
+	self.mutex.Unlock()
+	dp, err := self.GetValueBySeqnumContext(ctx, seqnum)
+	if err != nil {
+		return "", err
+	}
+	return dp.Name, nil
+}
+
 func (self *DeviceParameterManager) GetList() (chan *DeviceParameter, error) {
-	// Interrupt the run goroutine
-	self.done <- true
+	return self.GetListContext(context.Background())
+}
+
+// GetListContext enumerates the parameters of the device. Cancelling the
+// context stops the enumeration and closes the delivery channel.
+func (self *DeviceParameterManager) GetListContext(ctx context.Context) (chan *DeviceParameter, error) {
+	if self.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, NewContextError("Get parameter list", err)
+	}
 
 	delivery := make(chan *DeviceParameter)
-	go self.getList(delivery)
+	go self.getList(ctx, delivery)
 
 	return delivery, nil
 }
 
+// accepted filters out packets from other nodes when a destination is used.
+func (self *DeviceParameterManager) accepted(packet moteconnection.Packet) bool {
+	if self.destination != 0 {
+		msg, ok := packet.(*moteconnection.Message)
+		if !ok || msg.Source() != self.destination {
+			self.Debug.Printf("Ignoring packet %s\n", packet)
+			return false
+		}
+	}
+	return true
+}
+
 func (self *DeviceParameterManager) receivedPacket(msg moteconnection.Packet) {
 	self.Debug.Printf("%s\n", msg)
 	payload := msg.GetPayload()
@@ -206,27 +429,178 @@ func (self *DeviceParameterManager) receivedPacket(msg moteconnection.Packet) {
 		if payload[0] == DP_HEARTBEAT {
 			p := new(DpHeartbeat)
 			if err := moteconnection.DeserializePacket(p, payload); err == nil {
-				self.heartbeat = time.Now()
-				self.devstart = self.heartbeat.Add(-time.Duration(p.Uptime) * time.Second)
-				// TODO check stuff
+				self.receivedHeartbeat(msg, p)
+			} else {
+				self.Error.Printf("Deserialize error %s %s\n", err, msg)
+			}
+		} else if payload[0] == DP_PARAMETER {
+			p := new(DpParameter)
+			if err := moteconnection.DeserializePacket(p, payload); err == nil {
+				dp := &DeviceParameter{p.Id, DeviceParameterType(p.Type), p.Seqnum, p.Value, time.Now(), nil}
+				self.cacheValue(dp)
+				self.receivedParameter(dp)
+			} else {
+				self.Error.Printf("Deserialize error %s %s\n", err, msg)
+			}
+		}
+	}
+}
+
+func newDeviceHeartbeat(msg moteconnection.Packet, p *DpHeartbeat) *DeviceHeartbeat {
+	hb := new(DeviceHeartbeat)
+	if m, ok := msg.(*moteconnection.Message); ok {
+		hb.Address = m.Source()
+	}
+	hb.Eui64 = p.Eui64
+	hb.Uptime = time.Duration(p.Uptime) * time.Second
+	hb.Timestamp = time.Now()
+	hb.DeviceStart = hb.Timestamp.Add(-hb.Uptime)
+	return hb
+}
+
+func (self *DeviceParameterManager) receivedHeartbeat(msg moteconnection.Packet, p *DpHeartbeat) {
+	hb := newDeviceHeartbeat(msg, p)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.heartbeat.IsZero() {
+		if self.eui64 != hb.Eui64 {
+			self.Warning.Printf("Device %016X replaced by %016X\n", self.eui64, hb.Eui64)
+			hb.Reboot = true
+		} else if hb.DeviceStart.Sub(self.devstart) > REBOOT_DETECTION_TOLERANCE {
+			self.Info.Printf("Device %016X rebooted, uptime %s\n", hb.Eui64, hb.Uptime)
+			hb.Reboot = true
+		}
+	}
+
+	if hb.Reboot { // Cached values are not valid any more
+		self.values = make(map[string]*DeviceParameter)
+	}
+
+	self.heartbeat = hb.Timestamp
+	self.devstart = hb.DeviceStart
+	self.eui64 = hb.Eui64
+
+	for _, subscriber := range self.heartbeatSubscribers {
+		select {
+		case subscriber <- hb:
+		default:
+			self.Debug.Printf("Heartbeat subscriber not keeping up\n")
+		}
+	}
+}
+
+// LastHeartbeat returns the time when the last heartbeat was received from
+// the device, zero if no heartbeats have been seen.
+func (self *DeviceParameterManager) LastHeartbeat() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.heartbeat
+}
+
+// DeviceStart returns the estimated start time of the device, based on the
+// uptime reported in the last heartbeat.
+func (self *DeviceParameterManager) DeviceStart() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.devstart
+}
+
+// Eui64 returns the EUI-64 reported in the last heartbeat, 0 if unknown.
+func (self *DeviceParameterManager) Eui64() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.eui64
+}
+
+// SubscribeHeartbeats returns a channel for receiving the heartbeats of the
+// device. Heartbeats are dropped if the subscriber does not keep up. The
+// channel is closed when the manager is closed.
+func (self *DeviceParameterManager) SubscribeHeartbeats() chan *DeviceHeartbeat {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	subscriber := make(chan *DeviceHeartbeat, 8)
+	if self.closed {
+		close(subscriber)
+	} else {
+		self.heartbeatSubscribers = append(self.heartbeatSubscribers, subscriber)
+	}
+	return subscriber
+}
+
+func (self *DeviceParameterManager) UnsubscribeHeartbeats(subscriber chan *DeviceHeartbeat) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i, s := range self.heartbeatSubscribers {
+		if s == subscriber {
+			self.heartbeatSubscribers = append(self.heartbeatSubscribers[:i], self.heartbeatSubscribers[i+1:]...)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+// receivedParameter delivers a parameter value that was not requested, for
+// example a report sent by the device after a local change.
+func (self *DeviceParameterManager) receivedParameter(dp *DeviceParameter) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, subscriber := range self.parameterSubscribers {
+		if subscriber.name == "*" || subscriber.name == dp.Name {
+			update := *dp
+			update.Value = append([]byte(nil), dp.Value...)
+			select {
+			case subscriber.updates <- &update:
+			default:
+				self.Debug.Printf("Parameter subscriber not keeping up\n")
 			}
 		}
 	}
 }
 
-func (self *DeviceParameterManager) waitValueId(name string) (*DeviceParameter, error) {
+// Subscribe returns a channel for receiving values of the parameter that the
+// device reports without being asked, "*" subscribes to all parameters.
+// Values are dropped if the subscriber does not keep up. The channel is closed
+// when the manager is closed.
+func (self *DeviceParameterManager) Subscribe(name string) chan *DeviceParameter {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	updates := make(chan *DeviceParameter, 8)
+	if self.closed {
+		close(updates)
+	} else {
+		self.parameterSubscribers = append(self.parameterSubscribers, &parameterSubscriber{name, updates})
+	}
+	return updates
+}
+
+func (self *DeviceParameterManager) Unsubscribe(updates chan *DeviceParameter) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i, s := range self.parameterSubscribers {
+		if s.updates == updates {
+			self.parameterSubscribers = append(self.parameterSubscribers[:i], self.parameterSubscribers[i+1:]...)
+			close(updates)
+			return
+		}
+	}
+}
+
+func (self *DeviceParameterManager) waitValueId(ctx context.Context, name string) (*DeviceParameter, error) {
+	timeout, _ := self.settings()
 	start := time.Now()
 	for {
 		select {
 		case packet := <-self.receive:
 			payload := packet.GetPayload()
-
-			if self.destination != 0 {
-				msg, ok := packet.(*moteconnection.Message)
-				if !ok || msg.Source() != self.destination {
-					self.Debug.Printf("Ignoring packet %s\n", packet)
-					payload = nil
-				}
+			if !self.accepted(packet) {
+				payload = nil
 			}
 
 			if len(payload) > 0 {
@@ -234,8 +608,11 @@ func (self *DeviceParameterManager) waitValueId(name string) (*DeviceParameter,
 					p := new(DpParameter)
 					if err := moteconnection.DeserializePacket(p, payload); err == nil {
 						if p.Id == name {
-							return &DeviceParameter{name, DeviceParameterType(p.Type), p.Seqnum, p.Value, time.Now(), nil}, nil
+							dp := &DeviceParameter{p.Id, DeviceParameterType(p.Type), p.Seqnum, p.Value, time.Now(), nil}
+							self.cacheValue(dp)
+							return dp, nil
 						}
+						self.receivedPacket(packet)
 					} else {
 						self.Error.Printf("Deserialize error %s %s\n", err, packet)
 					}
@@ -244,10 +621,7 @@ func (self *DeviceParameterManager) waitValueId(name string) (*DeviceParameter,
 					if err := moteconnection.DeserializePacket(p, payload); err == nil {
 						if p.Id == name {
 							if p.Exists {
-								if p.Err == 6 { // EINVAL
-									return nil, NewInvalidParameterValueError(fmt.Sprintf("Something went wrong with parameter \"%s\", error %d - EINVAL!", name, p.Err))
-								}
-								return nil, errors.New(fmt.Sprintf("Something went wrong with parameter \"%s\", error %d!", name, p.Err))
+								return nil, NewDeviceError(name, DeviceErrorCode(p.Err))
 							} else {
 								return nil, NewParameterError(fmt.Sprintf("No parameter \"%s\" on device!", name))
 							}
@@ -261,25 +635,25 @@ func (self *DeviceParameterManager) waitValueId(name string) (*DeviceParameter,
 					self.receivedPacket(packet)
 				}
 			}
-		case <-time.After(remaining(start, self.timeout)):
+		case <-ctx.Done():
+			return nil, NewContextError(fmt.Sprintf("Parameter \"%s\"", name), ctx.Err())
+		case <-self.done:
+			return nil, ErrClosed
+		case <-time.After(remaining(start, timeout)):
 			return nil, NewTimeoutError(fmt.Sprintf("Timeout for parameter \"%s\"!", name))
 		}
 	}
 }
 
-func (self *DeviceParameterManager) waitValueSeqnum(seqnum uint8) (*DeviceParameter, error) {
+func (self *DeviceParameterManager) waitValueSeqnum(ctx context.Context, seqnum uint8) (*DeviceParameter, error) {
+	timeout, _ := self.settings()
 	start := time.Now()
 	for {
 		select {
 		case packet := <-self.receive:
 			payload := packet.GetPayload()
-
-			if self.destination != 0 {
-				msg, ok := packet.(*moteconnection.Message)
-				if !ok || msg.Source() != self.destination {
-					self.Debug.Printf("Ignoring packet %s\n", packet)
-					payload = nil
-				}
+			if !self.accepted(packet) {
+				payload = nil
 			}
 
 			if len(payload) > 0 {
@@ -287,8 +661,11 @@ func (self *DeviceParameterManager) waitValueSeqnum(seqnum uint8) (*DeviceParame
 					p := new(DpParameter)
 					if err := moteconnection.DeserializePacket(p, payload); err == nil {
 						if p.Seqnum == seqnum {
-							return &DeviceParameter{p.Id, DeviceParameterType(p.Type), p.Seqnum, p.Value, time.Now(), nil}, nil
+							dp := &DeviceParameter{p.Id, DeviceParameterType(p.Type), p.Seqnum, p.Value, time.Now(), nil}
+							self.cacheValue(dp)
+							return dp, nil
 						}
+						self.receivedPacket(packet)
 					} else {
 						self.Error.Printf("Deserialize error %s %s\n", err, packet)
 					}
@@ -297,7 +674,7 @@ func (self *DeviceParameterManager) waitValueSeqnum(seqnum uint8) (*DeviceParame
 					if err := moteconnection.DeserializePacket(p, payload); err == nil {
 						if p.Seqnum == seqnum {
 							if p.Exists {
-								return nil, errors.New(fmt.Sprintf("Something went wrong with parameter %d, error %d!", seqnum, p.Err))
+								return nil, NewDeviceSeqnumError(seqnum, DeviceErrorCode(p.Err))
 							} else {
 								return nil, NewParameterError(fmt.Sprintf("No parameter %d on device!", seqnum))
 							}
@@ -311,131 +688,180 @@ func (self *DeviceParameterManager) waitValueSeqnum(seqnum uint8) (*DeviceParame
 					self.receivedPacket(packet)
 				}
 			}
-		case <-time.After(remaining(start, self.timeout)):
+		case <-ctx.Done():
+			return nil, NewContextError(fmt.Sprintf("Parameter %d", seqnum), ctx.Err())
+		case <-self.done:
+			return nil, ErrClosed
+		case <-time.After(remaining(start, timeout)):
 			return nil, NewTimeoutError(fmt.Sprintf("Timeout for parameter %d!", seqnum))
 		}
 	}
 }
 
-func (self *DeviceParameterManager) getList(delivery chan *DeviceParameter) {
-	for i := 0; i < 256; i++ {
-		for retries := 0; retries <= self.retries; retries++ {
-			self.Debug.Printf("Get %d %d/%d\n", i, retries, self.retries)
-			// Send get request
-			msg := self.dsp.NewPacket()
-			if self.destination != 0 {
-				msg.(*moteconnection.Message).SetDestination(self.destination)
-				msg.(*moteconnection.Message).SetType(AMID_DEVICE_PARAMETERS)
-			}
-			payload := new(DpGetParameterSeqnum)
-			payload.Header = DP_GET_PARAMETER_WITH_SEQNUM
-			payload.Seqnum = uint8(i)
-			msg.SetPayload(moteconnection.SerializePacket(payload))
-			self.sfc.Send(msg)
-
-			// Wait for value
-			dp, err := self.waitValueSeqnum(uint8(i))
-			if err == nil {
-				delivery <- dp
+func (self *DeviceParameterManager) getValueSeqnum(ctx context.Context, seqnum uint8) (*DeviceParameter, error) {
+	var result error = errors.New("disabled")
+
+	_, retries := self.settings()
+	for retry := 0; retry <= retries; retry++ {
+		self.Debug.Printf("Get %d %d/%d\n", seqnum, retry, retries)
+		// Send get request
+		msg := self.newPacket()
+		payload := new(DpGetParameterSeqnum)
+		payload.Header = DP_GET_PARAMETER_WITH_SEQNUM
+		payload.Seqnum = seqnum
+		msg.SetPayload(moteconnection.SerializePacket(payload))
+		self.sfc.Send(msg)
+
+		// Wait for value
+		dp, err := self.waitValueSeqnum(ctx, seqnum)
+		if err == nil {
+			return dp, nil
+		} else {
+			self.Debug.Printf("Got %s\n", err)
+			result = err
+			if !retryable(err) {
 				break
+			}
+		}
+	}
+
+	return nil, result
+}
+
+func (self *DeviceParameterManager) setValueSeqnum(ctx context.Context, seqnum uint8, value []byte) (*DeviceParameter, error) {
+	var result error = errors.New("disabled")
+
+	_, retries := self.settings()
+	for retry := 0; retry <= retries; retry++ {
+		// Send set request
+		msg := self.newPacket()
+		payload := new(DpSetParameterSeqnum)
+		payload.Header = DP_SET_PARAMETER_WITH_SEQNUM
+		payload.Seqnum = seqnum
+		payload.Value = value
+		msg.SetPayload(moteconnection.SerializePacket(payload))
+		self.sfc.Send(msg)
+
+		// Wait for value
+		dp, err := self.waitValueSeqnum(ctx, seqnum)
+		if err == nil {
+			if bytes.Compare(dp.Value, value) == 0 {
+				return dp, nil
 			} else {
-				self.Debug.Printf("Got %s\n", err)
-				if _, ok := err.(*ParameterError); ok { // This parameter does not exist and therefore the list is complete
-					self.Debug.Printf("closing")
-					close(delivery)
-					go self.run()
-					return
-				} else if retries == self.retries {
-					delivery <- &DeviceParameter{"", 0, uint8(i), nil, time.Now(), err}
-					break
-				}
+				return dp, newValueMismatchError(value, dp.Value)
+			}
+		} else {
+			result = err
+			if !retryable(err) {
+				break
 			}
 		}
 	}
 
-	close(delivery)
-	go self.run()
+	return nil, result
+}
+
+func (self *DeviceParameterManager) getList(ctx context.Context, delivery chan *DeviceParameter) {
+	defer close(delivery)
+
+	for i := 0; i < 256; i++ {
+		seqnum := uint8(i)
+		dp, err := self.GetValueBySeqnumContext(ctx, seqnum)
+		if err != nil {
+			var pe *ParameterError
+			var ce *ContextError
+			if errors.As(err, &pe) { // This parameter does not exist and therefore the list is complete
+				self.Debug.Printf("closing")
+				return
+			} else if errors.As(err, &ce) || errors.Is(err, ErrClosed) { // Enumeration was cancelled or the manager closed
+				return
+			}
+			dp = &DeviceParameter{"", 0, seqnum, nil, time.Now(), err}
+		}
+
+		select {
+		case delivery <- dp:
+		case <-ctx.Done(): // Nobody may be listening any more
+			return
+		}
+	}
+}
+
+// retryable reports if it makes sense to repeat a request that ended with err.
+func retryable(err error) bool {
+	var pe *ParameterError
+	var ce *ContextError
+	var de *DeviceError
+	if errors.As(err, &pe) || errors.As(err, &ce) || errors.Is(err, ErrClosed) {
+		return false
+	}
+	if errors.As(err, &de) {
+		return de.Temporary()
+	}
+	return true
 }
 
 func (self *DeviceParameterManager) run() {
+	defer close(self.stopped)
+
 	self.Debug.Printf("DPM running\n")
 	for {
 		select {
 		case packet := <-self.receive:
-			msg := packet
-			self.receivedPacket(msg)
-		case done := <-self.done:
-			if done {
-				self.Debug.Printf("DPM interrupted\n")
-			} else {
-				self.Debug.Printf("DPM closed\n")
+			if self.accepted(packet) {
+				self.receivedPacket(packet)
+			}
+		case req := <-self.requests:
+			if req.ctx.Err() != nil {
+				continue // The caller has already given up
 			}
+			dp, err := req.action(req.ctx)
+			req.result <- response{dp, err}
+		case <-self.done:
+			self.Debug.Printf("DPM closed\n")
 			return
 		}
 	}
 }
 
 func (self *DeviceParameterManager) Close() error {
-	if !self.closed {
-		self.closed = true
-		close(self.done)
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return errors.New("Close has already been called!")
+	}
+	self.closed = true
+	self.mutex.Unlock()
+
+	// Remove the dispatcher first, the run goroutine keeps draining the receive
+	// channel until then, so that the connection can not get stuck on delivery.
+	if self.detach != nil {
+		self.detach()
+	} else {
 		self.sfc.RemoveDispatcher(self.dsp)
-		return nil
 	}
-	return errors.New("Close has already been called!")
+	close(self.done)
+	<-self.stopped
+
+	self.mutex.Lock()
+	for _, subscriber := range self.heartbeatSubscribers {
+		close(subscriber)
+	}
+	self.heartbeatSubscribers = nil
+	for _, subscriber := range self.parameterSubscribers {
+		close(subscriber.updates)
+	}
+	self.parameterSubscribers = nil
+	self.mutex.Unlock()
+	return nil
 }
 
 func (self *DeviceParameter) String() string {
-	if self.Type == DP_TYPE_RAW {
-		return fmt.Sprintf("%X", self.Value)
-	} else if self.Type == DP_TYPE_STRING {
-		return string(self.Value)
-	} else {
-		s := fmt.Sprintf("%v", self.Value)
-		buf := bytes.NewBuffer(self.Value)
-		if self.Type == DP_TYPE_UINT8 {
-			var v uint8
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_UINT16 {
-			var v uint16
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_UINT32 {
-			var v uint32
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_UINT64 {
-			var v uint64
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_INT8 {
-			var v int8
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_INT16 {
-			var v int16
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_INT32 {
-			var v int32
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if self.Type == DP_TYPE_INT64 {
-			var v int64
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		}
-		return s
+	s, err := ParameterValueString(self.Type, self.Value)
+	if err != nil {
+		return fmt.Sprintf("%X (%s)", self.Value, err)
 	}
+	return s
 }
 
 func remaining(start time.Time, timeout time.Duration) time.Duration {
@@ -0,0 +1,303 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dp "github.com/thinnect/go-devparam"
+	"github.com/thinnect/go-devparam/devsim"
+)
+
+func TestDpm(t *testing.T) {
+	net := devsim.NewNetwork()
+	net.SetSerialNode(devsim.NewNode(0x0001, 0x0011223344556677,
+		devsim.Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{26}},
+		devsim.Parameter{Name: "ident_timestamp", Type: dp.DP_TYPE_INT64, Value: []byte{0, 0, 0, 0, 0x5C, 0x2B, 0x3A, 0x00}}))
+	defer net.Close()
+
+	sfc, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfc.Disconnect()
+
+	dpm := dp.NewDeviceParameterManager(sfc)
+	defer dpm.Close()
+	dpm.SetTimeout(100 * time.Millisecond)
+
+	if v1, err := dpm.GetValue("radio_channel"); err != nil || v1.String() != "26" {
+		t.Errorf("radio_channel: %v %v", v1, err)
+	}
+
+	if v2, err := dpm.GetValue("ident_timestamp"); err != nil || v2.String() != "1546336768" {
+		t.Errorf("ident_timestamp: %v %v", v2, err)
+	}
+
+	var missing *dp.ParameterError
+	if _, err := dpm.GetValue("dummy"); !errors.As(err, &missing) {
+		t.Errorf("dummy: %v", err)
+	}
+
+	dpm.SetTimeout(0)
+	if _, err := dpm.GetValue("dummy"); err == nil {
+		t.Errorf("dummy succeeded without a timeout")
+	}
+
+	dpm.SetTimeout(100 * time.Millisecond)
+	if v, err := dpm.SetValue("radio_channel", []byte{11}); err != nil || !bytes.Equal(v.Value, []byte{11}) {
+		t.Errorf("set radio_channel: %v %v", v, err)
+	}
+}
+
+func TestCachedValue(t *testing.T) {
+	net := devsim.NewNetwork()
+	node := devsim.NewNode(0x0001, 0x0011223344556677,
+		devsim.Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{26}},
+		devsim.Parameter{Name: "name", Type: dp.DP_TYPE_STRING, Value: []byte("node")})
+	node.SetUptime(time.Hour)
+	net.AddNode(node)
+	defer net.Close()
+
+	sfc, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfc.Disconnect()
+
+	dpm := dp.NewDeviceParameterActiveMessageManager(sfc, 0x22, 0x5678, 0x0001)
+	defer dpm.Close()
+	dpm.SetTimeout(100 * time.Millisecond)
+	hbs := dpm.SubscribeHeartbeats()
+
+	if v := dpm.CachedValue("radio_channel"); v != nil {
+		t.Errorf("unexpected cached value %v", v)
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := dpm.GetCachedValue("radio_channel", time.Minute); err != nil || v.String() != "26" {
+			t.Errorf("cached get: %v %v", v, err)
+		}
+	}
+	if n := node.Requests(); n != 1 {
+		t.Errorf("%d requests instead of 1", n)
+	}
+
+	node.SetValue("radio_channel", []byte{11})
+	time.Sleep(10 * time.Millisecond)
+	if v, err := dpm.GetCachedValue("radio_channel", 5*time.Millisecond); err != nil || v.String() != "11" {
+		t.Errorf("stale value not refreshed: %v %v", v, err)
+	}
+
+	// Values learned through the list are cached as well
+	pchan, err := dpm.GetList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range pchan {
+	}
+	requests := node.Requests()
+	if v, err := dpm.GetCachedValue("name", time.Minute); err != nil || v.String() != "node" || node.Requests() != requests {
+		t.Errorf("list not cached: %v %v", v, err)
+	}
+
+	heartbeat := func() {
+		net.Heartbeat(0x0001)
+		select {
+		case <-hbs:
+		case <-time.After(time.Second):
+			t.Fatalf("no heartbeat")
+		}
+	}
+	heartbeat()
+	if v := dpm.CachedValue("radio_channel"); v == nil {
+		t.Errorf("cache cleared without a reboot")
+	}
+	node.Reboot()
+	heartbeat()
+	if v := dpm.CachedValue("radio_channel"); v != nil {
+		t.Errorf("cache not cleared on reboot, %v", v)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	net := devsim.NewNetwork()
+	node := devsim.NewNode(0x0001, 0x0011223344556677,
+		devsim.Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{26}},
+		devsim.Parameter{Name: "name", Type: dp.DP_TYPE_STRING, Value: []byte("node")})
+	net.AddNode(node)
+	net.AddNode(devsim.NewNode(0x0002, 0x0011223344556678,
+		devsim.Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{26}}))
+	defer net.Close()
+
+	sfc, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfc.Disconnect()
+
+	dpm := dp.NewDeviceParameterActiveMessageManager(sfc, 0x22, 0x5678, 0x0001)
+	dpm.SetTimeout(100 * time.Millisecond)
+	channel := dpm.Subscribe("radio_channel")
+	all := dpm.Subscribe("*")
+
+	receive := func(updates chan *dp.DeviceParameter) *dp.DeviceParameter {
+		select {
+		case v := <-updates:
+			return v
+		case <-time.After(time.Second):
+			t.Fatalf("no update")
+		}
+		return nil
+	}
+
+	node.SetValue("radio_channel", []byte{11})
+	net.Report(0x0002, "radio_channel") // Another node, must be ignored
+	net.Report(0x0001, "radio_channel")
+	if v := receive(channel); v.Name != "radio_channel" || v.String() != "11" {
+		t.Errorf("unexpected update %v", v)
+	}
+	if v := receive(all); v.Name != "radio_channel" {
+		t.Errorf("unexpected update %v", v)
+	}
+	if v := dpm.CachedValue("radio_channel"); v == nil || v.String() != "11" {
+		t.Errorf("report not cached, %v", v)
+	}
+
+	net.Report(0x0001, "name")
+	if v := receive(all); v.Name != "name" || v.String() != "node" {
+		t.Errorf("unexpected update %v", v)
+	}
+
+	// Responses to requests are not reported as updates
+	if _, err := dpm.SetValue("radio_channel", []byte{15}); err != nil {
+		t.Errorf("set: %v", err)
+	}
+	dpm.Unsubscribe(channel)
+	if _, ok := <-channel; ok {
+		t.Errorf("update delivered for own request")
+	}
+
+	dpm.Close()
+	if _, ok := <-all; ok {
+		t.Errorf("subscription not closed")
+	}
+}
+
+func TestDiscoverSchema(t *testing.T) {
+	net := devsim.NewNetwork()
+	node := devsim.NewNode(0x0001, 0x0011223344556677,
+		devsim.Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{26}},
+		devsim.Parameter{Name: "name", Type: dp.DP_TYPE_STRING, Value: []byte("node"), MaxLength: 16},
+		devsim.Parameter{Name: "offset", Type: dp.DP_TYPE_INT16, Value: []byte{0xFF, 0xFE}})
+	net.AddNode(node)
+	defer net.Close()
+
+	sfc, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfc.Disconnect()
+
+	dpm := dp.NewDeviceParameterActiveMessageManager(sfc, 0x22, 0x5678, 0x0001)
+	defer dpm.Close()
+	dpm.SetTimeout(100 * time.Millisecond)
+	hbs := dpm.SubscribeHeartbeats()
+	net.Heartbeat(0x0001)
+	<-hbs
+
+	schema, err := dpm.DiscoverSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Eui64 != "0011223344556677" || schema.Captured == nil || len(schema.Parameters) != 3 {
+		t.Fatalf("unexpected schema %+v", schema)
+	}
+
+	for _, name := range []string{"schema.json", "schema.yaml"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := dp.WriteSchema(path, schema); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := dp.ReadSchema(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Eui64 != schema.Eui64 || !stored.Captured.Equal(*schema.Captured) {
+			t.Errorf("%s: unexpected schema %+v", name, stored)
+		}
+
+		expected := []struct {
+			name   string
+			dpt    dp.DeviceParameterType
+			seqnum uint8
+			length int
+			value  string
+		}{
+			{"radio_channel", dp.DP_TYPE_UINT8, 0, 1, "26"},
+			{"name", dp.DP_TYPE_STRING, 1, 4, "node"},
+			{"offset", dp.DP_TYPE_INT16, 2, 2, "-2"},
+		}
+		for i, e := range expected {
+			ps := stored.Parameters[i]
+			if ps.Name != e.name || ps.Type != e.dpt || ps.Seqnum == nil || *ps.Seqnum != e.seqnum || ps.Length != e.length || ps.Value != e.value {
+				t.Errorf("%s: unexpected parameter %+v", name, ps)
+			}
+		}
+
+		if err := stored.Validate("radio_channel", dp.DP_TYPE_UINT8, []byte{11}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		if err := stored.Validate("offset", dp.DP_TYPE_UINT16, nil); err == nil {
+			t.Errorf("%s: type mismatch not detected", name)
+		}
+	}
+
+	node.SetFaults(devsim.Faults{Offline: true})
+	dpm.SetRetries(0)
+	if _, err := dpm.DiscoverSchema(); err == nil {
+		t.Errorf("incomplete enumeration not detected")
+	}
+}
+
+func TestSetValueBySeqnumSchema(t *testing.T) {
+	net := devsim.NewNetwork()
+	node := devsim.NewNode(0x0001, 0x0011223344556677,
+		devsim.Parameter{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Value: []byte{26}})
+	net.AddNode(node)
+	defer net.Close()
+
+	sfc, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfc.Disconnect()
+
+	schema := &dp.Schema{Parameters: []*dp.ParameterSchema{{Name: "radio_channel", Type: dp.DP_TYPE_UINT8, Allowed: []string{"15", "26"}}}}
+	if err := schema.Init(); err != nil {
+		t.Fatal(err)
+	}
+	dpm := dp.NewDeviceParameterActiveMessageManager(sfc, 0x22, 0x5678, 0x0001)
+	defer dpm.Close()
+	dpm.SetTimeout(100 * time.Millisecond)
+	dpm.SetSchema(schema)
+
+	// The schema has no sequence numbers, the parameter is queried first
+	var se *dp.SchemaError
+	if _, err := dpm.SetValueBySeqnum(0, []byte{30}); !errors.As(err, &se) {
+		t.Errorf("expected SchemaError, got %v", err)
+	}
+	if v, _ := node.Value("radio_channel"); !bytes.Equal(v, []byte{26}) || node.Requests() != 1 {
+		t.Errorf("invalid value was set, %X after %d requests", v, node.Requests())
+	}
+	if v, err := dpm.SetValueBySeqnum(0, []byte{15}); err != nil || !bytes.Equal(v.Value, []byte{15}) {
+		t.Errorf("set radio_channel: %v %v", v, err)
+	}
+	if n := node.Requests(); n != 2 {
+		t.Errorf("%d requests instead of 2", n)
+	}
+}
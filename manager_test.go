@@ -4,56 +4,208 @@
 package deviceparameters
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/proactivity-lab/go-moteconnection"
 )
 
-func TestDpm(t *testing.T) {
-	sfc := moteconnection.NewSfConnection("localhost", 9002)
+func TestGetValueContextDeadline(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, nothing will answer
 	dp := NewDeviceParameterManager(sfc)
+	defer dp.Close()
 
-	logformat := log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile
-	debuglogger := log.New(os.Stdout, "DEBUG: ", logformat)
-	infologger := log.New(os.Stdout, "INFO:  ", logformat)
-	warninglogger := log.New(os.Stdout, "WARN:  ", logformat)
-	errorlogger := log.New(os.Stdout, "ERROR: ", logformat)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
 
-	sfc.SetDebugLogger(debuglogger)
-	sfc.SetInfoLogger(infologger)
-	sfc.SetWarningLogger(warninglogger)
-	sfc.SetErrorLogger(errorlogger)
+	start := time.Now()
+	_, err := dp.GetValueContext(ctx, "radio_channel")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cancellation took %s", elapsed)
+	}
 
-	dp.SetDebugLogger(debuglogger)
-	dp.SetInfoLogger(infologger)
-	dp.SetWarningLogger(warninglogger)
-	dp.SetErrorLogger(errorlogger)
+	if _, err := dp.GetValueContext(ctx, "radio_channel"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error for expired context, got %v", err)
+	}
+}
 
-	sfc.Autoconnect(30 * time.Second)
+func TestConcurrentCallsAndClose(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, nothing will answer
+	dp := NewDeviceParameterManager(sfc)
+	dp.SetTimeout(10 * time.Millisecond)
+	dp.SetRetries(0)
 
-	time.Sleep(time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := dp.GetValue(fmt.Sprintf("p%d", i)); err == nil {
+				t.Errorf("unexpected success for p%d", i)
+			}
+		}(i)
+	}
+	wg.Wait()
 
-	v1, err := dp.GetValue("radio_channel")
-	fmt.Printf("%v %v\n", v1, err)
+	if err := dp.Close(); err != nil {
+		t.Errorf("close failed: %s", err)
+	}
+	if err := dp.Close(); err == nil {
+		t.Errorf("second close did not fail")
+	}
 
-	v2, err := dp.GetValue("ident_timestamp")
-	fmt.Printf("%v %v\n", v2, err)
+	if _, err := dp.GetValue("radio_channel"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := dp.SetValue("radio_channel", []byte{11}); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := dp.GetList(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
 
-	v3, err := dp.GetValue("dummy")
-	fmt.Printf("%v %v\n", v3, err)
+func TestHeartbeat(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, heartbeats are injected
+	dp := NewDeviceParameterManager(sfc)
+	hbs := dp.SubscribeHeartbeats()
 
-	dp.SetTimeout(0)
-	v4, err := dp.GetValue("dummy")
-	fmt.Printf("%v %v\n", v4, err)
+	heartbeat := func(eui64 uint64, uptime uint32) *DeviceHeartbeat {
+		p := moteconnection.NewRawPacket(TOS_SERIAL_DEVICE_PARAMETERS_ID)
+		p.SetPayload(moteconnection.SerializePacket(&DpHeartbeat{DP_HEARTBEAT, eui64, uptime}))
+		dp.receive <- p
+		select {
+		case hb := <-hbs:
+			return hb
+		case <-time.After(time.Second):
+			t.Fatalf("heartbeat not delivered")
+		}
+		return nil
+	}
 
-	dp.SetTimeout(time.Second)
-	_, err = dp.SetValue("radio_channel", []byte{11})
-	fmt.Printf("s %v\n", err)
+	if !dp.LastHeartbeat().IsZero() || dp.Eui64() != 0 {
+		t.Errorf("unexpected heartbeat information before any heartbeats")
+	}
+
+	hb := heartbeat(0x0011223344556677, 3600)
+	if hb.Reboot || hb.Eui64 != 0x0011223344556677 || hb.Uptime != time.Hour {
+		t.Errorf("unexpected heartbeat %+v", hb)
+	}
+	if dp.Eui64() != 0x0011223344556677 || dp.LastHeartbeat() != hb.Timestamp || dp.DeviceStart() != hb.DeviceStart {
+		t.Errorf("accessors do not match heartbeat %+v", hb)
+	}
+
+	if hb = heartbeat(0x0011223344556677, 3601); hb.Reboot {
+		t.Errorf("reboot detected for a regular heartbeat")
+	}
+	if hb = heartbeat(0x0011223344556677, 10); !hb.Reboot {
+		t.Errorf("reboot not detected")
+	}
+	if hb = heartbeat(0x0011223344556678, 20); !hb.Reboot {
+		t.Errorf("device replacement not detected")
+	}
 
 	dp.Close()
-	sfc.Disconnect()
+	if _, ok := <-hbs; ok {
+		t.Errorf("subscription not closed")
+	}
+}
+
+func TestValueBySeqnum(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, responses are injected
+	dp := NewDeviceParameterManager(sfc)
+	defer dp.Close()
+	dp.SetRetries(0)
+
+	inject := func(payload interface{}) {
+		time.Sleep(20 * time.Millisecond)
+		p := moteconnection.NewRawPacket(TOS_SERIAL_DEVICE_PARAMETERS_ID)
+		p.SetPayload(moteconnection.SerializePacket(payload))
+		dp.receive <- p
+	}
+
+	go func() {
+		inject(&DpParameter{Header: DP_PARAMETER, Type: uint8(DP_TYPE_UINT8), Seqnum: 2, Id: "other", Value: []byte{1}})
+		inject(&DpParameter{Header: DP_PARAMETER, Type: uint8(DP_TYPE_UINT8), Seqnum: 3, Id: "radio_channel", Value: []byte{11}})
+	}()
+	if v, err := dp.GetValueBySeqnum(3); err != nil {
+		t.Errorf("get: %s", err)
+	} else if v.Name != "radio_channel" || v.Seqnum != 3 {
+		t.Errorf("unexpected parameter %+v", v)
+	}
+
+	go inject(&DpParameter{Header: DP_PARAMETER, Type: uint8(DP_TYPE_UINT8), Seqnum: 3, Id: "radio_channel", Value: []byte{11}})
+	if v, err := dp.SetValueBySeqnum(3, []byte{12}); err == nil {
+		t.Errorf("mismatch not detected")
+	} else if _, ok := err.(*ValueMismatchError); !ok || v == nil || v.Value[0] != 11 {
+		t.Errorf("unexpected result %v %v", v, err)
+	}
+
+	go inject(&DpErrorParameterSeqnum{Header: DP_ERROR_PARAMETER_SEQNUM, Exists: false, Seqnum: 9})
+	if _, err := dp.GetValueBySeqnum(9); err == nil {
+		t.Errorf("missing parameter not detected")
+	} else if _, ok := err.(*ParameterError); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDeviceErrors(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, responses are injected
+	dp := NewDeviceParameterManager(sfc)
+	defer dp.Close()
+	dp.SetRetries(0)
+
+	inject := func(payload interface{}) {
+		time.Sleep(20 * time.Millisecond)
+		p := moteconnection.NewRawPacket(TOS_SERIAL_DEVICE_PARAMETERS_ID)
+		p.SetPayload(moteconnection.SerializePacket(payload))
+		dp.receive <- p
+	}
+
+	go inject(&DpErrorParameterId{Header: DP_ERROR_PARAMETER_ID, Exists: true, Err: uint8(ErrBusy), Id: "radio_channel"})
+	_, err := dp.SetValue("radio_channel", []byte{11})
+	var de *DeviceError
+	if !errors.Is(err, ErrBusy) || !errors.As(err, &de) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if de.Name != "radio_channel" || de.Code != ErrBusy || !de.Temporary() {
+		t.Errorf("unexpected device error %+v", de)
+	}
+
+	go inject(&DpErrorParameterId{Header: DP_ERROR_PARAMETER_ID, Exists: true, Err: uint8(ErrInvalid), Id: "radio_channel"})
+	_, err = dp.SetValue("radio_channel", []byte{11, 12})
+	if _, ok := err.(*InvalidParameterValueError); !ok || !errors.Is(err, ErrInvalid) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	go inject(&DpErrorParameterSeqnum{Header: DP_ERROR_PARAMETER_SEQNUM, Exists: true, Err: uint8(ErrSize), Seqnum: 4})
+	_, err = dp.SetValueBySeqnum(4, []byte{11, 12, 13})
+	if !errors.Is(err, ErrSize) || !errors.As(err, &de) || !de.BySeqnum || de.Seqnum != 4 || de.Temporary() {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnsolicitedValueCached(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, reports are injected
+	dp := NewDeviceParameterManager(sfc)
+	defer dp.Close()
+
+	p := moteconnection.NewRawPacket(TOS_SERIAL_DEVICE_PARAMETERS_ID)
+	p.SetPayload(moteconnection.SerializePacket(&DpParameter{Header: DP_PARAMETER, Type: uint8(DP_TYPE_UINT8), Seqnum: 1, Id: "radio_channel", Value: []byte{15}}))
+	dp.receive <- p
+
+	deadline := time.Now().Add(time.Second)
+	for dp.CachedValue("radio_channel") == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := dp.GetCachedValue("radio_channel", time.Minute); err != nil || v.Value[0] != 15 || v.Seqnum != 1 {
+		t.Errorf("unexpected cached value %v %v", v, err)
+	}
 }
@@ -2,10 +2,6 @@ package deviceparameters
 
 import "fmt"
 import "errors"
-import "encoding/hex"
-import "encoding/binary"
-import "bytes"
-import "strconv"
 
 type DeviceParameterType uint8
 
@@ -53,6 +49,37 @@ func (dpt DeviceParameterType) String() string {
 	return DeviceParameterTypeToString[dpt]
 }
 
+func (dpt DeviceParameterType) MarshalText() ([]byte, error) {
+	if s, ok := DeviceParameterTypeToString[dpt]; ok {
+		return []byte(s), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unrecognized parameter type 0x%02X!", uint8(dpt)))
+}
+
+func (dpt *DeviceParameterType) UnmarshalText(text []byte) error {
+	t, err := ParseDeviceParameterType(string(text))
+	if err != nil {
+		return err
+	}
+	*dpt = t
+	return nil
+}
+
+// Size returns the length of values of fixed size types, 0 for raw and str.
+func (dpt DeviceParameterType) Size() int {
+	switch dpt {
+	case DP_TYPE_UINT8, DP_TYPE_INT8:
+		return 1
+	case DP_TYPE_UINT16, DP_TYPE_INT16:
+		return 2
+	case DP_TYPE_UINT32, DP_TYPE_INT32:
+		return 4
+	case DP_TYPE_UINT64, DP_TYPE_INT64:
+		return 8
+	}
+	return 0
+}
+
 func ParseDeviceParameterType(name string) (DeviceParameterType, error) {
 	v, ok := DeviceParameterStringToType[name]
 	if ok {
@@ -62,134 +89,30 @@ func ParseDeviceParameterType(name string) (DeviceParameterType, error) {
 }
 
 func ParseParameterValue(tpt DeviceParameterType, tval string) ([]byte, error) {
-	var value []byte
-	var err error
-	var t interface{}
-
-	switch tpt {
-	case DP_TYPE_RAW:
-		return hex.DecodeString(tval)
-	case DP_TYPE_STRING:
-		return []byte(tval), nil
-	case DP_TYPE_NIL:
-		return nil, nil
-	case DP_TYPE_UINT8:
-		if v, err := strconv.ParseUint(tval, 10, 8); err == nil {
-			t = uint8(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_UINT16:
-		if v, err := strconv.ParseUint(tval, 10, 16); err == nil {
-			t = uint16(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_UINT32:
-		if v, err := strconv.ParseUint(tval, 10, 32); err == nil {
-			t = uint32(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_UINT64:
-		if v, err := strconv.ParseUint(tval, 10, 64); err == nil {
-			t = uint64(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_INT8:
-		if v, err := strconv.ParseInt(tval, 10, 8); err == nil {
-			t = int8(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_INT16:
-		if v, err := strconv.ParseInt(tval, 10, 16); err == nil {
-			t = int16(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_INT32:
-		if v, err := strconv.ParseInt(tval, 10, 32); err == nil {
-			t = int32(v)
-		} else {
-			return nil, err
-		}
-	case DP_TYPE_INT64:
-		if v, err := strconv.ParseInt(tval, 10, 64); err == nil {
-			t = int64(v)
-		} else {
-			return nil, err
-		}
+	codec, err := LookupCodec(tpt)
+	if err != nil {
+		return nil, err
 	}
+	return codec.Encode(tval)
+}
 
-	if t != nil {
-		switch t := t.(type) {
-		case uint8, uint16, uint32, uint64, int8, int16, int32, int64:
-			buf := new(bytes.Buffer)
-			if err := binary.Write(buf, binary.BigEndian, t); err != nil {
-				return nil, err
-			}
-			value = buf.Bytes()
-		}
+func ParameterValueString(dpt DeviceParameterType, value []byte) (string, error) {
+	codec, err := LookupCodec(dpt)
+	if err != nil {
+		return fmt.Sprintf("%X", value), err
 	}
-
-	return value, err
+	return codec.Decode(value)
 }
 
-func ParameterValueString(dpt DeviceParameterType, value []byte) (string, error) {
-	if dpt == DP_TYPE_NIL {
-		return fmt.Sprintf("%X", value), nil
-	} else if dpt == DP_TYPE_RAW {
-		return fmt.Sprintf("%X", value), nil
-	} else if dpt == DP_TYPE_STRING {
-		return string(value), nil
-	} else {
-		s := fmt.Sprintf("%v", value)
-		buf := bytes.NewBuffer(value)
-		if dpt == DP_TYPE_UINT8 {
-			var v uint8
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_UINT16 {
-			var v uint16
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_UINT32 {
-			var v uint32
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_UINT64 {
-			var v uint64
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_INT8 {
-			var v int8
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_INT16 {
-			var v int16
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_INT32 {
-			var v int32
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else if dpt == DP_TYPE_INT64 {
-			var v int64
-			if err := binary.Read(buf, binary.BigEndian, &v); err == nil {
-				s = fmt.Sprintf("%d", v)
-			}
-		} else {
-			return s, errors.New("Unrecognized parameter type!")
-		}
-		return s, nil
+// FormatParameterValue is ParameterValueString with a choice of format for
+// integer values, other values are presented as usual.
+func FormatParameterValue(dpt DeviceParameterType, value []byte, format ValueFormat) (string, error) {
+	codec, err := LookupCodec(dpt)
+	if err != nil {
+		return fmt.Sprintf("%X", value), err
+	}
+	if fc, ok := codec.(FormattedCodec); ok {
+		return fc.DecodeFormat(value, format)
 	}
+	return codec.Decode(value)
 }
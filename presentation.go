@@ -0,0 +1,261 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "math"
+import "errors"
+import "strings"
+import "strconv"
+import "encoding/binary"
+
+// Presentation describes how the value of a parameter is shown to people when
+// it differs from the plain form of the device type, for example a
+// temperature in tenths of a degree stored in an i16.
+type Presentation interface {
+	Parse(dpt DeviceParameterType, text string) ([]byte, error)
+	Format(dpt DeviceParameterType, value []byte) (string, error)
+	String() string // Specification accepted by ParsePresentation
+}
+
+// ParsePresentation parses a presentation specification:
+//
+//	scaled:FACTOR[:OFFSET[:UNIT]] - integer, presented as value*FACTOR+OFFSET
+//	float                         - IEEE 754 float in 4 or 8 bytes
+//	float32, float64              - IEEE 754 float of the given size
+//	bool                          - integer, 0 is false and anything else true
+func ParsePresentation(spec string) (Presentation, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	switch parts[0] {
+	case "float":
+		if len(parts) == 1 {
+			return Float{}, nil
+		}
+	case "float32":
+		if len(parts) == 1 {
+			return Float{Size: 4}, nil
+		}
+	case "float64":
+		if len(parts) == 1 {
+			return Float{Size: 8}, nil
+		}
+	case "bool":
+		if len(parts) == 1 {
+			return Bool{}, nil
+		}
+	case "scaled":
+		if len(parts) > 1 {
+			var sc Scaled
+			var err error
+			if sc.Factor, err = strconv.ParseFloat(parts[1], 64); err != nil || sc.Factor == 0 {
+				return nil, errors.New(fmt.Sprintf("'%s' is not a valid scaling factor!", parts[1]))
+			}
+			if len(parts) > 2 {
+				if sc.Offset, err = strconv.ParseFloat(parts[2], 64); err != nil {
+					return nil, errors.New(fmt.Sprintf("'%s' is not a valid offset!", parts[2]))
+				}
+			}
+			if len(parts) > 3 {
+				sc.Unit = parts[3]
+			}
+			return sc, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("'%s' is not a valid presentation!", spec))
+}
+
+// ParsePresentedValue converts text to the value of the device type, using
+// the presentation when it is not nil.
+func ParsePresentedValue(dpt DeviceParameterType, p Presentation, text string) ([]byte, error) {
+	if p == nil {
+		return ParseParameterValue(dpt, text)
+	}
+	return p.Parse(dpt, text)
+}
+
+// PresentedValueString converts a value of the device type to text, using the
+// presentation when it is not nil.
+func PresentedValueString(dpt DeviceParameterType, p Presentation, value []byte) (string, error) {
+	if p == nil {
+		return ParameterValueString(dpt, value)
+	}
+	return p.Format(dpt, value)
+}
+
+// Scaled presents an integer as a fixed-point number, the presented value is
+// the device value multiplied by Factor, plus Offset. Unit is appended when
+// formatting and optional when parsing.
+type Scaled struct {
+	Factor float64
+	Offset float64
+	Unit   string
+}
+
+func (sc Scaled) Parse(dpt DeviceParameterType, text string) ([]byte, error) {
+	c, err := builtinIntegerCodec(dpt)
+	if err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+	if len(sc.Unit) > 0 {
+		text = strings.TrimSpace(strings.TrimSuffix(text, sc.Unit))
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, errors.New(fmt.Sprintf("'%s' is not a valid number!", text))
+	}
+	raw := math.Round((v - sc.Offset) / sc.Factor)
+	if raw == 0 {
+		raw = 0 // Rounding may give -0, which unsigned codecs do not accept
+	}
+	return c.Encode(strconv.FormatFloat(raw, 'f', 0, 64))
+}
+
+func (sc Scaled) Format(dpt DeviceParameterType, value []byte) (string, error) {
+	c, err := builtinIntegerCodec(dpt)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Validate(value); err != nil {
+		return "", err
+	}
+	var raw float64
+	if c.signed {
+		raw = float64(int64(c.integer(value)))
+	} else {
+		raw = float64(c.integer(value))
+	}
+	s := strconv.FormatFloat(raw*sc.Factor+sc.Offset, 'f', sc.decimals(), 64)
+	if len(sc.Unit) > 0 {
+		s = s + " " + sc.Unit
+	}
+	return s, nil
+}
+
+// decimals returns the number of decimal places that the factor and offset
+// can produce, so that rounding errors are not shown.
+func (sc Scaled) decimals() int {
+	d := 0
+	for _, f := range []float64{sc.Factor, sc.Offset} {
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if i := strings.Index(s, "."); i >= 0 && len(s)-i-1 > d {
+			d = len(s) - i - 1
+		}
+	}
+	return d
+}
+
+func (sc Scaled) String() string {
+	s := "scaled:" + strconv.FormatFloat(sc.Factor, 'g', -1, 64)
+	if sc.Offset != 0 || len(sc.Unit) > 0 {
+		s = s + ":" + strconv.FormatFloat(sc.Offset, 'g', -1, 64)
+	}
+	if len(sc.Unit) > 0 {
+		s = s + ":" + sc.Unit
+	}
+	return s
+}
+
+// Float presents a big-endian IEEE 754 float, carried by a raw parameter of 4
+// or 8 bytes or by a u32 or u64. Without a size, raw parameters use 4 bytes
+// when parsing.
+type Float struct {
+	Size int // Size of the float in bytes, 0 to take it from the type
+}
+
+// size returns the size of the float for the type, based on the value for
+// raw parameters when the size is not given.
+func (f Float) size(dpt DeviceParameterType, value []byte) (int, error) {
+	size := 0
+	switch dpt {
+	case DP_TYPE_UINT32:
+		size = 4
+	case DP_TYPE_UINT64:
+		size = 8
+	case DP_TYPE_RAW:
+		size = f.Size
+		if size == 0 {
+			size = 4
+			if len(value) == 8 {
+				size = 8
+			}
+		}
+	default:
+		return 0, errors.New(fmt.Sprintf("%s can not carry a float!", dpt))
+	}
+	if f.Size != 0 && f.Size != size {
+		return 0, errors.New(fmt.Sprintf("%s can not carry a %d byte float!", dpt, f.Size))
+	}
+	return size, nil
+}
+
+func (f Float) Parse(dpt DeviceParameterType, text string) ([]byte, error) {
+	size, err := f.size(dpt, nil)
+	if err != nil {
+		return nil, err
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(text), size*8)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("'%s' is not a valid number!", text))
+	}
+	value := make([]byte, size)
+	if size == 4 {
+		binary.BigEndian.PutUint32(value, math.Float32bits(float32(v)))
+	} else {
+		binary.BigEndian.PutUint64(value, math.Float64bits(v))
+	}
+	return value, nil
+}
+
+func (f Float) Format(dpt DeviceParameterType, value []byte) (string, error) {
+	size, err := f.size(dpt, value)
+	if err != nil {
+		return "", err
+	}
+	if len(value) != size {
+		return "", errors.New(fmt.Sprintf("Value %X is not a valid float, %d bytes expected!", value, size))
+	}
+	if size == 4 {
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'g', -1, 32), nil
+	}
+	return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64), nil
+}
+
+func (f Float) String() string {
+	if f.Size > 0 {
+		return fmt.Sprintf("float%d", f.Size*8)
+	}
+	return "float"
+}
+
+// Bool presents an integer as a boolean, true is stored as 1.
+type Bool struct{}
+
+func (Bool) Parse(dpt DeviceParameterType, text string) ([]byte, error) {
+	c, err := builtinIntegerCodec(dpt)
+	if err != nil {
+		return nil, err
+	}
+	v, err := strconv.ParseBool(strings.TrimSpace(text))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("'%s' is not a valid boolean!", text))
+	}
+	if v {
+		return c.Encode("1")
+	}
+	return c.Encode("0")
+}
+
+func (Bool) Format(dpt DeviceParameterType, value []byte) (string, error) {
+	c, err := builtinIntegerCodec(dpt)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Validate(value); err != nil {
+		return "", err
+	}
+	return strconv.FormatBool(c.integer(value) != 0), nil
+}
+
+func (Bool) String() string { return "bool" }
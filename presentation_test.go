@@ -0,0 +1,111 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPresentations(t *testing.T) {
+	tests := []struct {
+		spec  string
+		dpt   DeviceParameterType
+		text  string
+		value []byte
+	}{
+		{"scaled:0.1", DP_TYPE_INT16, "21.5", []byte{0x00, 0xD7}},
+		{"scaled:0.1", DP_TYPE_INT16, "-0.3", []byte{0xFF, 0xFD}},
+		{"scaled:0.1:0:°C", DP_TYPE_INT16, "21.5 °C", []byte{0x00, 0xD7}},
+		{"scaled:0.5:-40", DP_TYPE_UINT8, "-39.5", []byte{0x01}},
+		{"scaled:100", DP_TYPE_UINT16, "6500", []byte{0x00, 0x41}},
+		{"scaled:0.01:0:V", DP_TYPE_UINT16, "3.30 V", []byte{0x01, 0x4A}},
+		{"float", DP_TYPE_RAW, "21.5", []byte{0x41, 0xAC, 0x00, 0x00}},
+		{"float", DP_TYPE_UINT32, "-1", []byte{0xBF, 0x80, 0x00, 0x00}},
+		{"float", DP_TYPE_UINT64, "0.1", []byte{0x3F, 0xB9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A}},
+		{"float64", DP_TYPE_RAW, "0.1", []byte{0x3F, 0xB9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A}},
+		{"float32", DP_TYPE_RAW, "-1", []byte{0xBF, 0x80, 0x00, 0x00}},
+		{"float64", DP_TYPE_UINT64, "21.5", []byte{0x40, 0x35, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"bool", DP_TYPE_UINT8, "true", []byte{1}},
+		{"bool", DP_TYPE_UINT8, "false", []byte{0}},
+		{"bool", DP_TYPE_INT32, "true", []byte{0, 0, 0, 1}},
+	}
+
+	for _, test := range tests {
+		p, err := ParsePresentation(test.spec)
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		if p.String() != test.spec {
+			t.Errorf("%s presented as %s", test.spec, p)
+		}
+		if value, err := ParsePresentedValue(test.dpt, p, test.text); err != nil || !bytes.Equal(value, test.value) {
+			t.Errorf("%s %s parse \"%s\": %X %v", test.spec, test.dpt, test.text, value, err)
+		}
+		if text, err := PresentedValueString(test.dpt, p, test.value); err != nil || text != test.text {
+			t.Errorf("%s %s format %X: \"%s\" %v", test.spec, test.dpt, test.value, text, err)
+		}
+	}
+
+	if text, err := PresentedValueString(DP_TYPE_RAW, Float{}, []byte{0x3F, 0xB9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A}); err != nil || text != "0.1" {
+		t.Errorf("8 byte raw float: \"%s\" %v", text, err)
+	}
+	if text, err := PresentedValueString(DP_TYPE_UINT8, Bool{}, []byte{5}); err != nil || text != "true" {
+		t.Errorf("bool 5: \"%s\" %v", text, err)
+	}
+	if value, err := ParsePresentedValue(DP_TYPE_UINT8, Scaled{Factor: 0.1, Offset: 20}, "19.98"); err != nil || !bytes.Equal(value, []byte{0}) {
+		t.Errorf("scaled rounded to -0: %X %v", value, err)
+	}
+	if value, err := ParsePresentedValue(DP_TYPE_UINT8, nil, "0x10"); err != nil || !bytes.Equal(value, []byte{0x10}) {
+		t.Errorf("without presentation: %X %v", value, err)
+	}
+}
+
+func TestPresentationErrors(t *testing.T) {
+	for _, spec := range []string{"", "scaled", "scaled:0", "scaled:x", "scaled:1:y", "float:4", "bool:1", "fixed"} {
+		if p, err := ParsePresentation(spec); err == nil {
+			t.Errorf("\"%s\" accepted as %s", spec, p)
+		}
+	}
+
+	parse := []struct {
+		p    Presentation
+		dpt  DeviceParameterType
+		text string
+	}{
+		{Scaled{Factor: 0.1}, DP_TYPE_INT8, "12.8"}, // Out of range
+		{Scaled{Factor: 0.1}, DP_TYPE_UINT8, "-1"},
+		{Scaled{Factor: 0.1}, DP_TYPE_RAW, "1"},
+		{Scaled{Factor: 0.1}, DP_TYPE_UINT8, "NaN"},
+		{Scaled{Factor: 0.1, Unit: "V"}, DP_TYPE_UINT8, "1 A"},
+		{Float{}, DP_TYPE_UINT8, "1.5"},
+		{Float{}, DP_TYPE_RAW, "abc"},
+		{Float{Size: 8}, DP_TYPE_UINT32, "1"},
+		{Bool{}, DP_TYPE_UINT8, "yes"},
+		{Bool{}, DP_TYPE_STRING, "true"},
+	}
+	for _, test := range parse {
+		if value, err := test.p.Parse(test.dpt, test.text); err == nil {
+			t.Errorf("%s %s parse \"%s\" succeeded with %X", test.p, test.dpt, test.text, value)
+		}
+	}
+
+	format := []struct {
+		p     Presentation
+		dpt   DeviceParameterType
+		value []byte
+	}{
+		{Scaled{Factor: 0.1}, DP_TYPE_INT16, []byte{1, 2, 3}},
+		{Float{}, DP_TYPE_RAW, []byte{1, 2}},
+		{Float{}, DP_TYPE_UINT32, []byte{1, 2}},
+		{Float{Size: 8}, DP_TYPE_RAW, []byte{0xBF, 0x80, 0x00, 0x00}},
+		{Bool{}, DP_TYPE_UINT8, nil},
+	}
+	for _, test := range format {
+		if text, err := test.p.Format(test.dpt, test.value); err == nil {
+			t.Errorf("%s %s format %X succeeded with \"%s\"", test.p, test.dpt, test.value, text)
+		}
+	}
+}
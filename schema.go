@@ -0,0 +1,291 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "os"
+import "fmt"
+import "bytes"
+import "errors"
+import "strconv"
+import "strings"
+import "time"
+import "path/filepath"
+import "encoding/json"
+
+import "gopkg.in/yaml.v3"
+
+// Schema describes the parameters that a device, usually a specific firmware
+// version, is expected to have. It is loaded from a JSON or YAML file.
+// Schemas created with DiscoverSchema also record the device and the time of
+// the snapshot.
+type Schema struct {
+	Firmware    string             `json:"firmware,omitempty" yaml:"firmware,omitempty"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Eui64       string             `json:"eui64,omitempty" yaml:"eui64,omitempty"`
+	Captured    *time.Time         `json:"captured,omitempty" yaml:"captured,omitempty"`
+	Parameters  []*ParameterSchema `json:"parameters" yaml:"parameters"`
+
+	index map[string]*ParameterSchema
+}
+
+// ParameterSchema describes a single parameter. Min and Max apply to integer
+// parameters and to the presented value when a presentation is used, Allowed
+// lists all acceptable values in text form. Enum names integer values and Flags
+// names bits of an integer, values are then limited to the named ones and are
+// presented symbolically, for example "sleepy_router" or "led|beacon". Seqnum,
+// Length and Value are only informational, they describe the parameter at the
+// time of a snapshot.
+type ParameterSchema struct {
+	Name         string              `json:"name" yaml:"name"`
+	Type         DeviceParameterType `json:"type" yaml:"type"`
+	Seqnum       *uint8              `json:"seqnum,omitempty" yaml:"seqnum,omitempty"`
+	Length       int                 `json:"length,omitempty" yaml:"length,omitempty"`
+	Value        string              `json:"value,omitempty" yaml:"value,omitempty"`
+	Presentation string              `json:"presentation,omitempty" yaml:"presentation,omitempty"`
+	Unit         string              `json:"unit,omitempty" yaml:"unit,omitempty"`
+	Min          *float64            `json:"min,omitempty" yaml:"min,omitempty"`
+	Max          *float64            `json:"max,omitempty" yaml:"max,omitempty"`
+	Allowed      []string            `json:"allowed,omitempty" yaml:"allowed,omitempty"`
+	Enum         map[string]int64    `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Flags        map[string]uint     `json:"flags,omitempty" yaml:"flags,omitempty"`
+	MaxLength    int                 `json:"maxlength,omitempty" yaml:"maxlength,omitempty"`
+	ReadOnly     bool                `json:"readonly,omitempty" yaml:"readonly,omitempty"`
+	Description  string              `json:"description,omitempty" yaml:"description,omitempty"`
+
+	presentation Presentation
+	symbols      *symbols
+	allowed      [][]byte
+}
+
+// ReadSchema loads a schema from a JSON or YAML file, the format is chosen
+// based on the file extension.
+func ReadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := new(Schema)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, schema)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, schema)
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: unsupported schema format!", path))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+
+	if err := schema.Init(); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	return schema, nil
+}
+
+// WriteSchema stores the schema in a JSON or YAML file, the format is chosen
+// based on the file extension.
+func WriteSchema(path string, schema *Schema) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if data, err = json.MarshalIndent(schema, "", "  "); err == nil {
+			data = append(data, '\n')
+		}
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(schema)
+	default:
+		return errors.New(fmt.Sprintf("%s: unsupported schema format!", path))
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Init checks the schema and prepares it for use, it must be called when a
+// Schema is constructed or modified without ReadSchema.
+func (schema *Schema) Init() error {
+	schema.index = make(map[string]*ParameterSchema)
+	for _, ps := range schema.Parameters {
+		if len(ps.Name) == 0 || len(ps.Name) > 16 {
+			return errors.New(fmt.Sprintf("'%s' is not a valid parameter name!", ps.Name))
+		}
+		if _, ok := schema.index[ps.Name]; ok {
+			return errors.New(fmt.Sprintf("Parameter \"%s\" is listed more than once!", ps.Name))
+		}
+		if err := ps.init(); err != nil {
+			return err
+		}
+		schema.index[ps.Name] = ps
+	}
+	return nil
+}
+
+func (ps *ParameterSchema) init() error {
+	if _, err := LookupCodec(ps.Type); err != nil {
+		return err
+	}
+
+	ps.presentation = nil
+	if len(ps.Presentation) > 0 {
+		p, err := ParsePresentation(ps.Presentation)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Parameter \"%s\": %s", ps.Name, err))
+		}
+		ps.presentation = p
+	}
+
+	syms, err := newSymbols(ps)
+	if err != nil {
+		return err
+	}
+	ps.symbols = syms
+
+	if ps.Min != nil || ps.Max != nil {
+		if _, ok := ps.presentation.(Bool); ok || (ps.presentation == nil && ps.Type.Size() == 0) {
+			return errors.New(fmt.Sprintf("Parameter \"%s\" is not numeric, min and max can not be used!", ps.Name))
+		}
+	}
+
+	ps.allowed = make([][]byte, 0, len(ps.Allowed))
+	for _, text := range ps.Allowed {
+		value, err := ps.ParseValue(text)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Parameter \"%s\" allowed value '%s' is not valid: %s", ps.Name, text, err))
+		}
+		ps.allowed = append(ps.allowed, value)
+	}
+	return nil
+}
+
+// Parameter returns the description of the parameter, nil if it is not part
+// of the schema.
+func (schema *Schema) Parameter(name string) *ParameterSchema {
+	return schema.index[name]
+}
+
+// Validate checks that the parameter exists with the given type and, when the
+// value is not nil, that the value can be set.
+func (schema *Schema) Validate(name string, dpt DeviceParameterType, value []byte) error {
+	ps := schema.Parameter(name)
+	if ps == nil {
+		return newSchemaError(name, "is not in the schema!")
+	}
+	if dpt != ps.Type {
+		return newTypeMismatchError(name, dpt, ps.Type)
+	}
+	if value != nil {
+		return ps.ValidateValue(value)
+	}
+	return nil
+}
+
+// ValidateValue checks that the value can be set for the parameter, using the
+// type from the schema.
+func (schema *Schema) ValidateValue(name string, value []byte) error {
+	ps := schema.Parameter(name)
+	if ps == nil {
+		return newSchemaError(name, "is not in the schema!")
+	}
+	return ps.ValidateValue(value)
+}
+
+func (ps *ParameterSchema) ValidateValue(value []byte) error {
+	if ps.ReadOnly {
+		return newSchemaError(ps.Name, "is read-only!")
+	}
+	codec, err := LookupCodec(ps.Type)
+	if err != nil {
+		return err
+	}
+	if err := codec.Validate(value); err != nil {
+		return newSchemaError(ps.Name, "value is not valid: %s", err)
+	}
+	if ps.MaxLength > 0 && len(value) > ps.MaxLength {
+		return newSchemaError(ps.Name, "value is longer than %d bytes!", ps.MaxLength)
+	}
+
+	if ps.symbols != nil {
+		if text, ok := ps.symbols.valid(value); !ok {
+			return newSchemaError(ps.Name, "%s", text)
+		}
+	}
+
+	if len(ps.allowed) > 0 {
+		found := false
+		for _, a := range ps.allowed {
+			if bytes.Equal(a, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return newSchemaError(ps.Name, "value %s is not one of %s!", ps.text(value), strings.Join(ps.Allowed, ", "))
+		}
+	}
+
+	if ps.Min != nil || ps.Max != nil {
+		v, err := ps.number(value)
+		if err != nil {
+			return newSchemaError(ps.Name, "value is not valid: %s", err)
+		}
+		if ps.Min != nil && v < *ps.Min {
+			return newSchemaError(ps.Name, "value %s is less than %s!", ps.text(value), strconv.FormatFloat(*ps.Min, 'g', -1, 64))
+		}
+		if ps.Max != nil && v > *ps.Max {
+			return newSchemaError(ps.Name, "value %s is greater than %s!", ps.text(value), strconv.FormatFloat(*ps.Max, 'g', -1, 64))
+		}
+	}
+	return nil
+}
+
+// ParseValue converts text to a value of the parameter, using its presentation
+// or symbols.
+func (ps *ParameterSchema) ParseValue(text string) ([]byte, error) {
+	if ps.symbols != nil {
+		return ps.symbols.parse(text)
+	}
+	return ParsePresentedValue(ps.Type, ps.presentation, text)
+}
+
+// FormatValue converts a value of the parameter to text, using its presentation
+// or symbols.
+func (ps *ParameterSchema) FormatValue(value []byte) (string, error) {
+	if ps.symbols != nil {
+		return ps.symbols.format(value)
+	}
+	return PresentedValueString(ps.Type, ps.presentation, value)
+}
+
+func (ps *ParameterSchema) text(value []byte) string {
+	if s, err := ps.FormatValue(value); err == nil {
+		return s
+	}
+	return fmt.Sprintf("%X", value)
+}
+
+// number returns the numeric value used for checking the range.
+func (ps *ParameterSchema) number(value []byte) (float64, error) {
+	if ps.presentation != nil {
+		s, err := ps.presentation.Format(ps.Type, value)
+		if err != nil {
+			return 0, err
+		}
+		if sc, ok := ps.presentation.(Scaled); ok && len(sc.Unit) > 0 {
+			s = strings.TrimSpace(strings.TrimSuffix(s, sc.Unit))
+		}
+		return strconv.ParseFloat(s, 64)
+	}
+	c, err := builtinIntegerCodec(ps.Type)
+	if err != nil {
+		return 0, err
+	}
+	if c.signed {
+		return float64(int64(c.integer(value))), nil
+	}
+	return float64(c.integer(value)), nil
+}
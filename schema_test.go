@@ -0,0 +1,259 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/proactivity-lab/go-moteconnection"
+)
+
+const testSchemaYAML = `
+firmware: example 1.0
+parameters:
+  - name: radio_channel
+    type: u8
+    seqnum: 3
+    min: 11
+    max: 26
+  - name: temperature
+    type: i16
+    presentation: scaled:0.1
+    unit: °C
+    min: -40
+    max: 85.5
+  - name: tx_power
+    type: i8
+    allowed: ["-10", "0", "4"]
+  - name: name
+    type: str
+    maxlength: 8
+  - name: uptime
+    type: u32
+    readonly: true
+    description: Seconds since boot
+`
+
+func writeTestSchema(t *testing.T, name string, content string) *Schema {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := ReadSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestSchema(t *testing.T) {
+	yamlSchema := writeTestSchema(t, "schema.yaml", testSchemaYAML)
+	data, err := json.Marshal(yamlSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonSchema := writeTestSchema(t, "schema.json", string(data))
+
+	for _, schema := range []*Schema{yamlSchema, jsonSchema} {
+		if schema.Firmware != "example 1.0" || len(schema.Parameters) != 5 {
+			t.Fatalf("unexpected schema %+v", schema)
+		}
+		if ps := schema.Parameter("uptime"); ps == nil || ps.Type != DP_TYPE_UINT32 || !ps.ReadOnly || ps.Description != "Seconds since boot" {
+			t.Errorf("unexpected uptime %+v", ps)
+		}
+
+		valid := []struct {
+			name  string
+			dpt   DeviceParameterType
+			value []byte
+		}{
+			{"radio_channel", DP_TYPE_UINT8, []byte{11}},
+			{"radio_channel", DP_TYPE_UINT8, []byte{26}},
+			{"radio_channel", DP_TYPE_UINT8, nil},
+			{"temperature", DP_TYPE_INT16, []byte{0xFE, 0x70}}, // -40.0
+			{"temperature", DP_TYPE_INT16, []byte{0x03, 0x57}}, // 85.5
+			{"tx_power", DP_TYPE_INT8, []byte{0xF6}},
+			{"name", DP_TYPE_STRING, []byte("node 1")},
+			{"uptime", DP_TYPE_UINT32, nil},
+		}
+		for _, test := range valid {
+			if err := schema.Validate(test.name, test.dpt, test.value); err != nil {
+				t.Errorf("%s %X: %s", test.name, test.value, err)
+			}
+		}
+
+		invalid := []struct {
+			name  string
+			dpt   DeviceParameterType
+			value []byte
+		}{
+			{"radio_channel", DP_TYPE_UINT8, []byte{10}},
+			{"radio_channel", DP_TYPE_UINT8, []byte{27}},
+			{"radio_channel", DP_TYPE_UINT8, []byte{11, 0}},
+			{"temperature", DP_TYPE_INT16, []byte{0xFE, 0x6F}}, // -40.1
+			{"temperature", DP_TYPE_INT16, []byte{0x03, 0x58}}, // 85.6
+			{"tx_power", DP_TYPE_INT8, []byte{1}},
+			{"name", DP_TYPE_STRING, []byte("too long name")},
+			{"uptime", DP_TYPE_UINT32, []byte{0, 0, 0, 1}},
+			{"missing", DP_TYPE_UINT8, []byte{1}},
+		}
+		for _, test := range invalid {
+			var se *SchemaError
+			if err := schema.Validate(test.name, test.dpt, test.value); !errors.As(err, &se) || se.Name != test.name {
+				t.Errorf("%s %X: expected SchemaError, got %v", test.name, test.value, err)
+			}
+		}
+
+		var tm *TypeMismatchError
+		if err := schema.Validate("radio_channel", DP_TYPE_UINT16, []byte{0, 11}); !errors.As(err, &tm) {
+			t.Errorf("expected TypeMismatchError, got %v", err)
+		}
+
+		ps := schema.Parameter("temperature")
+		if v, err := ps.ParseValue("21.5"); err != nil || ps.text(v) != "21.5" {
+			t.Errorf("temperature: %X %v", v, err)
+		}
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	schemas := []string{
+		`parameters: [{name: "", type: u8}]`,
+		`parameters: [{name: twice, type: u8}, {name: twice, type: u8}]`,
+		`parameters: [{name: p, type: u9}]`,
+		`parameters: [{name: p, type: u8, presentation: fixed}]`,
+		`parameters: [{name: p, type: str, min: 1}]`,
+		`parameters: [{name: p, type: u8, presentation: bool, max: 1}]`,
+		`parameters: [{name: p, type: u8, allowed: ["256"]}]`,
+	}
+	for _, content := range schemas {
+		path := filepath.Join(t.TempDir(), "schema.yml")
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := ReadSchema(path); err == nil {
+			t.Errorf("accepted %s", content)
+		}
+	}
+}
+
+func TestManagerSchema(t *testing.T) {
+	sfc := moteconnection.NewSfConnection("localhost", 9002) // Not connected, nothing may be sent
+	dp := NewDeviceParameterManager(sfc)
+	defer dp.Close()
+	dp.SetRetries(0)
+	dp.SetSchema(writeTestSchema(t, "schema.yaml", testSchemaYAML))
+
+	var se *SchemaError
+	if _, err := dp.SetValue("radio_channel", []byte{30}); !errors.As(err, &se) {
+		t.Errorf("expected SchemaError, got %v", err)
+	}
+	if err := dp.SetUint32("uptime", 1); !errors.As(err, &se) {
+		t.Errorf("expected SchemaError, got %v", err)
+	}
+	var timeout *TimeoutError
+	if _, err := dp.SetValue("radio_channel", []byte{20}); !errors.As(err, &timeout) {
+		t.Errorf("expected TimeoutError, got %v", err)
+	}
+
+	// The parameter is found by the sequence number in the schema or the cache
+	if _, err := dp.SetValueBySeqnum(3, []byte{30}); !errors.As(err, &se) || se.Name != "radio_channel" {
+		t.Errorf("expected SchemaError, got %v", err)
+	}
+	dp.cacheValue(&DeviceParameter{Name: "uptime", Type: DP_TYPE_UINT32, Seqnum: 7, Value: []byte{0, 0, 0, 1}})
+	if _, err := dp.SetValueBySeqnum(7, []byte{0, 0, 0, 2}); !errors.As(err, &se) || se.Name != "uptime" {
+		t.Errorf("expected SchemaError, got %v", err)
+	}
+}
+
+func TestSchemaSymbols(t *testing.T) {
+	schema := writeTestSchema(t, "schema.yaml", `
+parameters:
+  - name: mode
+    type: u8
+    enum: {router: 1, sleepy_router: 3, leaf: 4}
+  - name: features
+    type: u16
+    flags: {led: 0, beacon: 1, debug: 15}
+  - name: level
+    type: i8
+    enum: {low: -1, high: 1}
+    allowed: ["1"]
+`)
+
+	tests := []struct {
+		name   string
+		text   string
+		value  []byte
+		output string
+	}{
+		{"mode", "sleepy_router", []byte{3}, "sleepy_router"},
+		{"mode", "4", []byte{4}, "leaf"},
+		{"features", "led|beacon", []byte{0x00, 0x03}, "led|beacon"},
+		{"features", "beacon | debug", []byte{0x80, 0x02}, "beacon|debug"},
+		{"features", "0", []byte{0x00, 0x00}, "0"},
+		{"features", "led|0x0100", []byte{0x01, 0x01}, "led|0x100"},
+		{"level", "low", []byte{0xFF}, "low"},
+		{"level", "high", []byte{0x01}, "high"},
+	}
+	for _, test := range tests {
+		ps := schema.Parameter(test.name)
+		value, err := ps.ParseValue(test.text)
+		if err != nil || !bytes.Equal(value, test.value) {
+			t.Errorf("%s %s: %X %v", test.name, test.text, value, err)
+			continue
+		}
+		if s, err := ps.FormatValue(value); err != nil || s != test.output {
+			t.Errorf("%s %X: %s %v", test.name, value, s, err)
+		}
+	}
+
+	for _, text := range []string{"router|leaf", "bridge"} {
+		if v, err := schema.Parameter("mode").ParseValue(text); err == nil {
+			t.Errorf("mode %s: parsed as %X", text, v)
+		}
+	}
+	if v, err := schema.Parameter("features").ParseValue("led|sound"); err == nil {
+		t.Errorf("features: parsed as %X", v)
+	}
+
+	var se *SchemaError
+	invalid := []struct {
+		name  string
+		value []byte
+	}{
+		{"mode", []byte{2}},
+		{"features", []byte{0x01, 0x01}},
+		{"level", []byte{0xFF}}, // Allowed restricts further
+	}
+	for _, test := range invalid {
+		if err := schema.ValidateValue(test.name, test.value); !errors.As(err, &se) {
+			t.Errorf("%s %X: expected SchemaError, got %v", test.name, test.value, err)
+		}
+	}
+	if err := schema.ValidateValue("level", []byte{0x01}); err != nil {
+		t.Errorf("level: %s", err)
+	}
+
+	errs := []string{
+		`parameters: [{name: p, type: str, enum: {a: 1}}]`,
+		`parameters: [{name: p, type: u8, enum: {a: 256}}]`,
+		`parameters: [{name: p, type: u8, enum: {a: -1}}]`,
+		`parameters: [{name: p, type: u8, enum: {"1": 1}}]`,
+		`parameters: [{name: p, type: u8, flags: {"a|b": 1}}]`,
+		`parameters: [{name: p, type: u8, flags: {a: 8}}]`,
+		`parameters: [{name: p, type: u8, enum: {a: 1}, flags: {b: 1}}]`,
+		`parameters: [{name: p, type: u8, presentation: bool, enum: {a: 1}}]`,
+	}
+	for _, content := range errs {
+		path := filepath.Join(t.TempDir(), "schema.yml")
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := ReadSchema(path); err == nil {
+			t.Errorf("accepted %s", content)
+		}
+	}
+}
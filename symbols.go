@@ -0,0 +1,191 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "sort"
+import "errors"
+import "strconv"
+import "strings"
+
+// symbols holds the parsed enum and flag names of an integer parameter.
+type symbols struct {
+	codec integerCodec
+	enum  map[string][]byte // Enum name to value
+	names map[string]string // Enum value to name
+	flags []flag            // Ordered by bit
+}
+
+type flag struct {
+	name string
+	mask uint64
+}
+
+func newSymbols(ps *ParameterSchema) (*symbols, error) {
+	if len(ps.Enum) == 0 && len(ps.Flags) == 0 {
+		return nil, nil
+	}
+	if len(ps.Enum) > 0 && len(ps.Flags) > 0 {
+		return nil, errors.New(fmt.Sprintf("Parameter \"%s\" can not have both enum and flags!", ps.Name))
+	}
+	if ps.presentation != nil {
+		return nil, errors.New(fmt.Sprintf("Parameter \"%s\" can not have enum or flags with a presentation!", ps.Name))
+	}
+	c, err := builtinIntegerCodec(ps.Type)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Parameter \"%s\" is not an integer, enum and flags can not be used!", ps.Name))
+	}
+
+	syms := &symbols{codec: c, enum: make(map[string][]byte), names: make(map[string]string)}
+	for _, name := range sortedNames(ps.Enum) {
+		if err := checkSymbol(name); err != nil {
+			return nil, errors.New(fmt.Sprintf("Parameter \"%s\": %s", ps.Name, err))
+		}
+		value, err := c.Encode(strconv.FormatInt(ps.Enum[name], 10))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Parameter \"%s\" enum %s: %s", ps.Name, name, err))
+		}
+		syms.enum[name] = value
+		if _, ok := syms.names[string(value)]; !ok { // Alphabetically first name is used for output
+			syms.names[string(value)] = name
+		}
+	}
+
+	for name, bit := range ps.Flags {
+		if err := checkSymbol(name); err != nil {
+			return nil, errors.New(fmt.Sprintf("Parameter \"%s\": %s", ps.Name, err))
+		}
+		if bit >= uint(c.size*8) {
+			return nil, errors.New(fmt.Sprintf("Parameter \"%s\" flag %s bit %d does not fit in %s!", ps.Name, name, bit, ps.Type))
+		}
+		syms.flags = append(syms.flags, flag{name, 1 << bit})
+	}
+	sort.Slice(syms.flags, func(i, j int) bool {
+		if syms.flags[i].mask == syms.flags[j].mask {
+			return syms.flags[i].name < syms.flags[j].name
+		}
+		return syms.flags[i].mask < syms.flags[j].mask
+	})
+	return syms, nil
+}
+
+func checkSymbol(name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, "| \t") {
+		return errors.New(fmt.Sprintf("'%s' is not a valid symbol name!", name))
+	}
+	if _, err := strconv.ParseInt(name, 0, 64); err == nil {
+		return errors.New(fmt.Sprintf("Symbol name '%s' is a number!", name))
+	}
+	return nil
+}
+
+func sortedNames(m map[string]int64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mask limits a sign extended integer to the size of the type.
+func (syms *symbols) mask(v uint64) uint64 {
+	if syms.codec.size < 8 {
+		return v & (1<<(uint(syms.codec.size)*8) - 1)
+	}
+	return v
+}
+
+// parse accepts enum names or flag names separated with |, numbers are
+// accepted in place of any name.
+func (syms *symbols) parse(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if len(syms.flags) == 0 {
+		if value, ok := syms.enum[text]; ok {
+			return value, nil
+		}
+		return syms.codec.Encode(text)
+	}
+
+	var v uint64
+	for _, part := range strings.Split(text, "|") {
+		part = strings.TrimSpace(part)
+		found := false
+		for _, f := range syms.flags {
+			if f.name == part {
+				v |= f.mask
+				found = true
+			}
+		}
+		if !found {
+			value, err := syms.codec.Encode(part)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("'%s' is not a flag or a number!", part))
+			}
+			v |= syms.mask(syms.codec.integer(value))
+		}
+	}
+	buf := make([]byte, 8)
+	for i := range buf {
+		buf[7-i] = byte(v >> (uint(i) * 8))
+	}
+	return buf[8-syms.codec.size:], nil
+}
+
+// format returns the enum name or the set flags, values and bits without a
+// name are presented as numbers.
+func (syms *symbols) format(value []byte) (string, error) {
+	if err := syms.codec.Validate(value); err != nil {
+		return "", err
+	}
+	if len(syms.flags) == 0 {
+		if name, ok := syms.names[string(value)]; ok {
+			return name, nil
+		}
+		return syms.codec.Decode(value)
+	}
+
+	v := syms.mask(syms.codec.integer(value))
+	parts := []string{}
+	for _, f := range syms.flags {
+		if v&f.mask != 0 {
+			parts = append(parts, f.name)
+		}
+	}
+	if rest := syms.unknown(value); rest != 0 {
+		parts = append(parts, fmt.Sprintf("0x%X", rest))
+	}
+	if len(parts) == 0 {
+		return "0", nil
+	}
+	return strings.Join(parts, "|"), nil
+}
+
+// unknown returns the bits that are set in the value but have no flag name.
+func (syms *symbols) unknown(value []byte) uint64 {
+	v := syms.mask(syms.codec.integer(value))
+	for _, f := range syms.flags {
+		v &^= f.mask
+	}
+	return v
+}
+
+// valid checks that the value is one of the enum values or only uses known
+// flags, the returned text completes a SchemaError.
+func (syms *symbols) valid(value []byte) (string, bool) {
+	if len(syms.flags) == 0 {
+		if _, ok := syms.names[string(value)]; !ok {
+			names := make([]string, 0, len(syms.enum))
+			for name := range syms.enum {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			text, _ := syms.codec.Decode(value)
+			return fmt.Sprintf("value %s is not one of %s!", text, strings.Join(names, ", ")), false
+		}
+	} else if rest := syms.unknown(value); rest != 0 {
+		return fmt.Sprintf("value has unknown flags 0x%X!", rest), false
+	}
+	return "", true
+}
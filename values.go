@@ -0,0 +1,190 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters
+
+import "fmt"
+import "strconv"
+import "encoding/hex"
+
+// Typed access to parameters. The type reported by the device must match the
+// requested type, otherwise a TypeMismatchError is returned. Values are
+// encoded and decoded with the codec of the type, integers are transferred in
+// big-endian byte order.
+
+func (self *DeviceParameterManager) getTyped(name string, dpt DeviceParameterType) (string, error) {
+	dp, err := self.GetValue(name)
+	if err != nil {
+		return "", err
+	}
+	return decodeTyped(dp, dpt)
+}
+
+// parameterType returns the type of the parameter from the schema or the
+// cache, the parameter is read if its type is not known yet.
+func (self *DeviceParameterManager) parameterType(name string) (DeviceParameterType, error) {
+	if schema := self.Schema(); schema != nil {
+		if ps := schema.Parameter(name); ps != nil {
+			return ps.Type, nil
+		}
+	}
+	if cached := self.CachedValue(name); cached != nil {
+		return cached.Type, nil
+	}
+	dp, err := self.GetValue(name)
+	if err != nil {
+		return 0, err
+	}
+	return dp.Type, nil
+}
+
+// setTyped checks the type of the parameter before the value is written.
+func (self *DeviceParameterManager) setTyped(name string, dpt DeviceParameterType, text string) error {
+	actual, err := self.parameterType(name)
+	if err != nil {
+		return err
+	}
+	if actual != dpt {
+		return newTypeMismatchError(name, dpt, actual)
+	}
+
+	codec, err := LookupCodec(dpt)
+	if err != nil {
+		return err
+	}
+	value, err := codec.Encode(text)
+	if err != nil {
+		return err
+	}
+
+	dp, err := self.SetValue(name, value)
+	if err != nil {
+		return err
+	}
+	if dp.Type != dpt {
+		return newTypeMismatchError(name, dpt, dp.Type)
+	}
+	return nil
+}
+
+func decodeTyped(dp *DeviceParameter, dpt DeviceParameterType) (string, error) {
+	if dp.Type != dpt {
+		return "", newTypeMismatchError(dp.Name, dpt, dp.Type)
+	}
+	codec, err := LookupCodec(dpt)
+	if err != nil {
+		return "", err
+	}
+	if err := codec.Validate(dp.Value); err != nil {
+		return "", NewInvalidParameterValueError(fmt.Sprintf("Parameter \"%s\": %s", dp.Name, err))
+	}
+	return codec.Decode(dp.Value)
+}
+
+func (self *DeviceParameterManager) getUint(name string, dpt DeviceParameterType) (uint64, error) {
+	text, err := self.getTyped(name, dpt)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(text, 10, 64)
+}
+
+func (self *DeviceParameterManager) getInt(name string, dpt DeviceParameterType) (int64, error) {
+	text, err := self.getTyped(name, dpt)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+func (self *DeviceParameterManager) GetUint8(name string) (uint8, error) {
+	v, err := self.getUint(name, DP_TYPE_UINT8)
+	return uint8(v), err
+}
+
+func (self *DeviceParameterManager) GetUint16(name string) (uint16, error) {
+	v, err := self.getUint(name, DP_TYPE_UINT16)
+	return uint16(v), err
+}
+
+func (self *DeviceParameterManager) GetUint32(name string) (uint32, error) {
+	v, err := self.getUint(name, DP_TYPE_UINT32)
+	return uint32(v), err
+}
+
+func (self *DeviceParameterManager) GetUint64(name string) (uint64, error) {
+	return self.getUint(name, DP_TYPE_UINT64)
+}
+
+func (self *DeviceParameterManager) GetInt8(name string) (int8, error) {
+	v, err := self.getInt(name, DP_TYPE_INT8)
+	return int8(v), err
+}
+
+func (self *DeviceParameterManager) GetInt16(name string) (int16, error) {
+	v, err := self.getInt(name, DP_TYPE_INT16)
+	return int16(v), err
+}
+
+func (self *DeviceParameterManager) GetInt32(name string) (int32, error) {
+	v, err := self.getInt(name, DP_TYPE_INT32)
+	return int32(v), err
+}
+
+func (self *DeviceParameterManager) GetInt64(name string) (int64, error) {
+	return self.getInt(name, DP_TYPE_INT64)
+}
+
+func (self *DeviceParameterManager) GetString(name string) (string, error) {
+	return self.getTyped(name, DP_TYPE_STRING)
+}
+
+// GetBytes returns the value of a raw parameter.
+func (self *DeviceParameterManager) GetBytes(name string) ([]byte, error) {
+	text, err := self.getTyped(name, DP_TYPE_RAW)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(text)
+}
+
+func (self *DeviceParameterManager) SetUint8(name string, v uint8) error {
+	return self.setTyped(name, DP_TYPE_UINT8, strconv.FormatUint(uint64(v), 10))
+}
+
+func (self *DeviceParameterManager) SetUint16(name string, v uint16) error {
+	return self.setTyped(name, DP_TYPE_UINT16, strconv.FormatUint(uint64(v), 10))
+}
+
+func (self *DeviceParameterManager) SetUint32(name string, v uint32) error {
+	return self.setTyped(name, DP_TYPE_UINT32, strconv.FormatUint(uint64(v), 10))
+}
+
+func (self *DeviceParameterManager) SetUint64(name string, v uint64) error {
+	return self.setTyped(name, DP_TYPE_UINT64, strconv.FormatUint(v, 10))
+}
+
+func (self *DeviceParameterManager) SetInt8(name string, v int8) error {
+	return self.setTyped(name, DP_TYPE_INT8, strconv.FormatInt(int64(v), 10))
+}
+
+func (self *DeviceParameterManager) SetInt16(name string, v int16) error {
+	return self.setTyped(name, DP_TYPE_INT16, strconv.FormatInt(int64(v), 10))
+}
+
+func (self *DeviceParameterManager) SetInt32(name string, v int32) error {
+	return self.setTyped(name, DP_TYPE_INT32, strconv.FormatInt(int64(v), 10))
+}
+
+func (self *DeviceParameterManager) SetInt64(name string, v int64) error {
+	return self.setTyped(name, DP_TYPE_INT64, strconv.FormatInt(v, 10))
+}
+
+func (self *DeviceParameterManager) SetString(name string, v string) error {
+	return self.setTyped(name, DP_TYPE_STRING, v)
+}
+
+// SetBytes sets the value of a raw parameter.
+func (self *DeviceParameterManager) SetBytes(name string, v []byte) error {
+	return self.setTyped(name, DP_TYPE_RAW, hex.EncodeToString(v))
+}
@@ -0,0 +1,122 @@
+// Author  Raido Pahtma
+// License MIT
+
+package deviceparameters_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	dp "github.com/thinnect/go-devparam"
+	"github.com/thinnect/go-devparam/devsim"
+)
+
+func TestTypedValues(t *testing.T) {
+	net := devsim.NewNetwork()
+	node := devsim.NewNode(0x0001, 0x0011223344556677,
+		devsim.Parameter{Name: "u8", Type: dp.DP_TYPE_UINT8, Value: []byte{26}},
+		devsim.Parameter{Name: "u16", Type: dp.DP_TYPE_UINT16, Value: []byte{0x12, 0x34}},
+		devsim.Parameter{Name: "u32", Type: dp.DP_TYPE_UINT32, Value: []byte{0, 0, 0, 1}},
+		devsim.Parameter{Name: "u64", Type: dp.DP_TYPE_UINT64, Value: []byte{0, 0, 0, 0, 0, 0, 1, 0}},
+		devsim.Parameter{Name: "i8", Type: dp.DP_TYPE_INT8, Value: []byte{0xFF}},
+		devsim.Parameter{Name: "i16", Type: dp.DP_TYPE_INT16, Value: []byte{0xFF, 0xFE}},
+		devsim.Parameter{Name: "i32", Type: dp.DP_TYPE_INT32, Value: []byte{0xFF, 0xFF, 0xFF, 0xFD}},
+		devsim.Parameter{Name: "i64", Type: dp.DP_TYPE_INT64, Value: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFC}},
+		devsim.Parameter{Name: "str", Type: dp.DP_TYPE_STRING, Value: []byte("node")},
+		devsim.Parameter{Name: "raw", Type: dp.DP_TYPE_RAW, Value: []byte{1, 2, 3}})
+	net.SetSerialNode(node)
+	defer net.Close()
+
+	sfc, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfc.Disconnect()
+
+	dpm := dp.NewDeviceParameterManager(sfc)
+	defer dpm.Close()
+	dpm.SetTimeout(100 * time.Millisecond)
+
+	if v, err := dpm.GetUint8("u8"); err != nil || v != 26 {
+		t.Errorf("u8: %v %v", v, err)
+	}
+	if v, err := dpm.GetUint16("u16"); err != nil || v != 0x1234 {
+		t.Errorf("u16: %v %v", v, err)
+	}
+	if v, err := dpm.GetUint32("u32"); err != nil || v != 1 {
+		t.Errorf("u32: %v %v", v, err)
+	}
+	if v, err := dpm.GetUint64("u64"); err != nil || v != 256 {
+		t.Errorf("u64: %v %v", v, err)
+	}
+	if v, err := dpm.GetInt8("i8"); err != nil || v != -1 {
+		t.Errorf("i8: %v %v", v, err)
+	}
+	if v, err := dpm.GetInt16("i16"); err != nil || v != -2 {
+		t.Errorf("i16: %v %v", v, err)
+	}
+	if v, err := dpm.GetInt32("i32"); err != nil || v != -3 {
+		t.Errorf("i32: %v %v", v, err)
+	}
+	if v, err := dpm.GetInt64("i64"); err != nil || v != -4 {
+		t.Errorf("i64: %v %v", v, err)
+	}
+	if v, err := dpm.GetString("str"); err != nil || v != "node" {
+		t.Errorf("str: %v %v", v, err)
+	}
+	if v, err := dpm.GetBytes("raw"); err != nil || !bytes.Equal(v, []byte{1, 2, 3}) {
+		t.Errorf("raw: %v %v", v, err)
+	}
+
+	if err := dpm.SetInt16("i16", -300); err != nil {
+		t.Errorf("set i16: %v", err)
+	}
+	if v, _ := node.Value("i16"); !bytes.Equal(v, []byte{0xFE, 0xD4}) {
+		t.Errorf("i16 stored as %X", v)
+	}
+	if err := dpm.SetUint64("u64", 0x0102030405060708); err != nil {
+		t.Errorf("set u64: %v", err)
+	}
+	if v, _ := node.Value("u64"); !bytes.Equal(v, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("u64 stored as %X", v)
+	}
+	if err := dpm.SetString("str", "renamed"); err != nil {
+		t.Errorf("set str: %v", err)
+	}
+
+	var mismatch *dp.TypeMismatchError
+	if _, err := dpm.GetUint16("u8"); !errors.As(err, &mismatch) || mismatch.Expected != dp.DP_TYPE_UINT16 || mismatch.Actual != dp.DP_TYPE_UINT8 {
+		t.Errorf("expected TypeMismatchError, got %v", err)
+	}
+	if _, err := dpm.GetString("raw"); !errors.As(err, &mismatch) {
+		t.Errorf("expected TypeMismatchError, got %v", err)
+	}
+
+	// The cached type prevents sending a value of the wrong type
+	requests := node.Requests()
+	if err := dpm.SetUint32("u8", 1); !errors.As(err, &mismatch) || node.Requests() != requests {
+		t.Errorf("expected TypeMismatchError without a request, got %v", err)
+	}
+	if v, _ := node.Value("u8"); !bytes.Equal(v, []byte{26}) {
+		t.Errorf("u8 changed to %X", v)
+	}
+
+	// Without a cached value the type is read before anything is set
+	conn, err := net.NewConnection(0x22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	fresh := dp.NewDeviceParameterManager(conn)
+	defer fresh.Close()
+	fresh.SetTimeout(100 * time.Millisecond)
+	value, _ := node.Value("i16")
+	if err := fresh.SetUint16("i16", 1); !errors.As(err, &mismatch) || mismatch.Actual != dp.DP_TYPE_INT16 {
+		t.Errorf("expected TypeMismatchError, got %v", err)
+	}
+	if v, _ := node.Value("i16"); !bytes.Equal(v, value) {
+		t.Errorf("i16 changed to %X", v)
+	}
+}